@@ -0,0 +1,121 @@
+// Package backoff retries failing calls with exponential backoff and guards
+// them with a circuit breaker so that a struggling dependency is not hammered
+package backoff
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Clock tells the time and waits, it is faked in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RealClock is the wall clock
+var RealClock Clock = realClock{}
+
+// retryAfterError is an error which says how long to wait before retrying
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter wraps err with how long the caller was told to wait before
+// retrying, e.g. by a Retry-After header. Retry waits this long rather than
+// its own delay and Breaker stays open for it
+func RetryAfter(err error, after time.Duration) error {
+	return &retryAfterError{err: err, after: after}
+}
+
+// retryAfter returns the wait an error was wrapped with by RetryAfter
+func retryAfter(err error) (time.Duration, bool) {
+	var ra *retryAfterError
+	if errors.As(err, &ra) {
+		return ra.after, true
+	}
+	return 0, false
+}
+
+// DefaultMaxDelay caps the delays of a Policy without a Max
+const DefaultMaxDelay = time.Hour
+
+// Policy is an exponential backoff policy, the delay before the nth retry is
+// Base * 2^n capped at Max, with the Jitter fraction of it randomised so that
+// clients retrying together spread out
+type Policy struct {
+	Base time.Duration
+	// Max caps the delay, 0 is DefaultMaxDelay
+	Max time.Duration
+	// Jitter is between 0, for no randomness, and 1, for a delay anywhere
+	// between 0 and the exponential delay
+	Jitter float64
+	// MaxAttempts is how many calls Retry makes before giving up, 0 retries
+	// until the context is done
+	MaxAttempts int
+	// Rand returns a random number in [0, 1), nil uses math/rand
+	Rand func() float64
+}
+
+// Delay returns how long to wait after the given attempt failed, attempts
+// count from 0
+func (p Policy) Delay(attempt int) time.Duration {
+	max := p.Max
+	if max <= 0 {
+		max = DefaultMaxDelay
+	}
+	// capping before converting to a Duration also stops large attempts
+	// overflowing it
+	delay := float64(p.Base) * math.Pow(2, float64(attempt))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	if p.Jitter > 0 {
+		random := rand.Float64
+		if p.Rand != nil {
+			random = p.Rand
+		}
+		delay -= p.Jitter * delay * random()
+	}
+	return time.Duration(delay)
+}
+
+// Retry calls fn until it succeeds, MaxAttempts calls have failed or ctx is
+// done, waiting between calls according to the policy or for as long as a
+// failed call was told to wait by RetryAfter. It returns the last error, or
+// ctx's error if ctx is done first. A nil clock is the wall clock
+func (p Policy) Retry(ctx context.Context, clock Clock, fn func(ctx context.Context) error) error {
+	if clock == nil {
+		clock = RealClock
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if p.MaxAttempts > 0 && attempt+1 >= p.MaxAttempts {
+			return err
+		}
+		delay, ok := retryAfter(err)
+		if !ok {
+			delay = p.Delay(attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(delay):
+		}
+	}
+}
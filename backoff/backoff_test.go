@@ -0,0 +1,108 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/backoff/backofftest"
+	"github.com/stretchr/testify/assert"
+)
+
+// failing returns a func which fails n times before succeeding and counts
+// its calls
+func failing(n int, err error) (func(context.Context) error, *int) {
+	calls := 0
+	return func(context.Context) error {
+		calls++
+		if calls <= n {
+			return err
+		}
+		return nil
+	}, &calls
+}
+
+func TestPolicyDelay(t *testing.T) {
+	a := assert.New(t)
+	p := Policy{Base: time.Second, Max: 10 * time.Second}
+	var delays []time.Duration
+	for attempt := 0; attempt < 6; attempt++ {
+		delays = append(delays, p.Delay(attempt))
+	}
+	a.Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second}, delays)
+
+	// large attempts do not overflow, without a Max the delay is capped at
+	// the default
+	a.Equal(10*time.Second, p.Delay(100))
+	a.Equal(10*time.Second, p.Delay(math.MaxInt32))
+	unbounded := Policy{Base: time.Second}
+	a.Equal(DefaultMaxDelay, unbounded.Delay(62))
+	a.Equal(DefaultMaxDelay, unbounded.Delay(5000))
+
+	// jitter takes up to its fraction off the delay
+	p.Jitter = 0.5
+	p.Rand = func() float64 { return 0 }
+	a.Equal(4*time.Second, p.Delay(2))
+	p.Rand = func() float64 { return 0.5 }
+	a.Equal(3*time.Second, p.Delay(2))
+	p.Rand = func() float64 { return 0.999 }
+	a.InDelta(float64(2*time.Second), float64(p.Delay(2)), float64(10*time.Millisecond))
+
+	// without a Rand the delay stays within the jitter
+	p.Rand = nil
+	for i := 0; i < 100; i++ {
+		delay := p.Delay(1)
+		a.True(delay > time.Second && delay <= 2*time.Second, delay)
+	}
+
+	// large attempts do not overflow
+	a.Equal(10*time.Second, Policy{Base: time.Second, Max: 10 * time.Second}.Delay(1000))
+}
+
+func TestPolicyRetry(t *testing.T) {
+	a := assert.New(t)
+	clock := backofftest.NewFakeClock()
+	p := Policy{Base: time.Second, Max: 5 * time.Second}
+
+	fn, calls := failing(4, errors.New("down"))
+	a.NoError(p.Retry(context.Background(), clock, fn))
+	a.Equal(5, *calls)
+	a.Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, clock.Waits())
+}
+
+func TestPolicyRetryMaxAttempts(t *testing.T) {
+	a := assert.New(t)
+	clock := backofftest.NewFakeClock()
+	p := Policy{Base: time.Second, MaxAttempts: 3}
+
+	down := errors.New("down")
+	fn, calls := failing(10, down)
+	a.Equal(down, p.Retry(context.Background(), clock, fn))
+	a.Equal(3, *calls)
+	a.Len(clock.Waits(), 2)
+}
+
+func TestPolicyRetryAfter(t *testing.T) {
+	a := assert.New(t)
+	clock := backofftest.NewFakeClock()
+	p := Policy{Base: time.Second}
+
+	// the wait we were told overrides the policy's delay
+	fn, _ := failing(1, RetryAfter(errors.New("rate limited"), 30*time.Second))
+	a.NoError(p.Retry(context.Background(), clock, fn))
+	a.Equal([]time.Duration{30 * time.Second}, clock.Waits())
+}
+
+func TestPolicyRetryCancelled(t *testing.T) {
+	a := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := Policy{Base: time.Hour}
+
+	fn, calls := failing(10, errors.New("down"))
+	a.Equal(context.Canceled, p.Retry(ctx, RealClock, fn))
+	a.Equal(1, *calls)
+}
@@ -0,0 +1,50 @@
+// Package backofftest provides a fake backoff.Clock for tests
+package backofftest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a backoff.Clock whose time only moves when it is waited on or
+// advanced, waits return immediately and are recorded
+type FakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+// NewFakeClock returns a FakeClock set to a fixed time
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Advance moves the clock on without recording a wait
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Waits returns how long each wait on the clock was for
+func (c *FakeClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
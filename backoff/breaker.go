@@ -0,0 +1,131 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by Breaker.Do without making the call while the
+// breaker is open, it is wrapped with RetryAfter for when the breaker will
+// next let a call through
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is the state of a Breaker
+type State int
+
+const (
+	// Closed lets every call through
+	Closed State = iota
+	// Open fails every call until the cooldown has passed
+	Open
+	// HalfOpen lets a single trial call through to decide whether to close
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Breaker is a circuit breaker. It opens after threshold consecutive calls
+// fail, or immediately when a call fails with RetryAfter, and then fails calls
+// without making them until the cooldown, or the RetryAfter wait, has passed.
+// A single trial call is then let through which closes the breaker if it
+// succeeds and opens it again if it fails
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	openUntil time.Time
+}
+
+// NewBreaker returns a closed Breaker, a nil clock is the wall clock
+func NewBreaker(threshold int, cooldown time.Duration, clock Clock) *Breaker {
+	if clock == nil {
+		clock = RealClock
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, clock: clock}
+}
+
+// State returns the state of the breaker, an open breaker whose cooldown has
+// passed is reported as half-open
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && !b.clock.Now().Before(b.openUntil) {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Do calls fn unless the breaker is open. Calls cancelled by their context
+// are not counted as failures. A nil Breaker always calls fn
+func (b *Breaker) Do(fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	switch b.state {
+	case Open:
+		if now.Before(b.openUntil) {
+			return RetryAfter(ErrOpen, b.openUntil.Sub(now))
+		}
+		b.state = HalfOpen
+	case HalfOpen:
+		// a trial call is already in flight
+		return RetryAfter(ErrOpen, b.cooldown)
+	}
+	return nil
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.state = Closed
+		b.failures = 0
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		if b.state == HalfOpen {
+			// let the next call be the trial instead
+			b.state = Open
+			b.openUntil = b.clock.Now()
+		}
+		return
+	}
+
+	b.failures++
+	wait, told := retryAfter(err)
+	if !told {
+		wait = b.cooldown
+	}
+	if told || b.state == HalfOpen || b.failures >= b.threshold {
+		b.state = Open
+		b.openUntil = b.clock.Now().Add(wait)
+	}
+}
@@ -0,0 +1,99 @@
+package backoff
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/backoff/backofftest"
+	"github.com/stretchr/testify/assert"
+)
+
+func succeed() error { return nil }
+
+func TestBreaker(t *testing.T) {
+	a := assert.New(t)
+	clock := backofftest.NewFakeClock()
+	b := NewBreaker(3, time.Minute, clock)
+	down := errors.New("down")
+	fail := func() error { return down }
+
+	// opens after three consecutive failures
+	a.Equal(down, b.Do(fail))
+	a.NoError(b.Do(succeed))
+	a.Equal(down, b.Do(fail))
+	a.Equal(down, b.Do(fail))
+	a.Equal(Closed, b.State())
+	a.Equal(down, b.Do(fail))
+	a.Equal(Open, b.State())
+
+	// calls fail without being made while open
+	clock.Advance(20 * time.Second)
+	called := false
+	err := b.Do(func() error { called = true; return nil })
+	a.False(called)
+	a.True(errors.Is(err, ErrOpen))
+	wait, ok := retryAfter(err)
+	a.True(ok)
+	a.Equal(40*time.Second, wait)
+
+	// a failed trial call after the cooldown opens it again
+	clock.Advance(40 * time.Second)
+	a.Equal(HalfOpen, b.State())
+	a.Equal(down, b.Do(fail))
+	a.Equal(Open, b.State())
+	a.True(errors.Is(b.Do(succeed), ErrOpen))
+
+	// and a successful one closes it
+	clock.Advance(time.Minute)
+	a.NoError(b.Do(succeed))
+	a.Equal(Closed, b.State())
+	a.Equal(down, b.Do(fail))
+	a.Equal(Closed, b.State())
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	a := assert.New(t)
+	clock := backofftest.NewFakeClock()
+	b := NewBreaker(3, time.Minute, clock)
+
+	// being told to wait opens the breaker at once for that long
+	rateLimited := RetryAfter(errors.New("rate limited"), 10*time.Second)
+	a.Equal(rateLimited, b.Do(func() error { return rateLimited }))
+	a.Equal(Open, b.State())
+	clock.Advance(10 * time.Second)
+	a.NoError(b.Do(succeed))
+	a.Equal(Closed, b.State())
+}
+
+func TestBreakerIgnoresCancellation(t *testing.T) {
+	a := assert.New(t)
+	b := NewBreaker(1, time.Minute, backofftest.NewFakeClock())
+	cancelled := func() error { return context.Canceled }
+
+	a.Equal(context.Canceled, b.Do(cancelled))
+	a.Equal(Closed, b.State())
+}
+
+func TestBreakerHalfOpenAllowsOneTrial(t *testing.T) {
+	a := assert.New(t)
+	clock := backofftest.NewFakeClock()
+	b := NewBreaker(1, time.Minute, clock)
+	b.Do(func() error { return errors.New("down") })
+	clock.Advance(time.Minute)
+
+	// calls made while the trial is in flight are refused
+	var concurrent error
+	a.NoError(b.Do(func() error {
+		concurrent = b.Do(succeed)
+		return nil
+	}))
+	a.True(errors.Is(concurrent, ErrOpen))
+	a.Equal(Closed, b.State())
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+	assert.NoError(t, b.Do(succeed))
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -15,11 +20,13 @@ import (
 	"github.com/aultimus/slack-user-data-service/util"
 	"github.com/cocoonlife/timber"
 	log "github.com/cocoonlife/timber"
+	"github.com/jmoiron/sqlx"
 
 	"net/http"
 	_ "net/http/pprof"
 
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func init() {
@@ -34,57 +41,196 @@ func init() {
 func main() {
 	log.Infof("server started")
 
-	var portNum = *flag.String("port", server.DefaultPortNum,
-		"TCP/IP port that this program listens on")
-	flag.Parse()
-	if portNum == "" {
-		portNum = server.DefaultPortNum
+	cfg, args, err := server.LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	if len(args) > 0 && args[0] == "migrate" {
+		migrate(cfg.DB, args[1:])
+		return
+	}
+
+	if err = cfg.Validate(); err != nil {
+		log.Fatalf(err.Error())
 	}
 
-	slackAPIToken := os.Getenv("SLACK_API_TOKEN")
-	if slackAPIToken == "" {
-		log.Fatal("SLACK_API_TOKEN env var not set")
+	// verification tokens are deprecated in favour of signing secrets so the
+	// token is only used if explicitly enabled
+	var verificationToken string
+	if cfg.Slack.VerificationTokenFallback {
+		log.Infof("slack verification token fallback enabled")
+		verificationToken = cfg.Slack.VerificationToken
 	}
+	verifier, err := server.NewVerifier(cfg.Slack.SigningSecret, verificationToken,
+		cfg.Webhooks.ReplayWindow)
+	if err != nil {
+		log.Fatalf("failed to set up slack request verification: %v", err)
+	}
+
+	// set up storage
+	var storer server.Storer
+	var dbConn *sqlx.DB
+	switch cfg.Store {
+	case "memory":
+		log.Warnf("using in-memory store, users will be lost on restart")
+		storer = db.NewMemory()
+	case "database", "postgres": // postgres is kept for older configs
+		dbConn = connectDB(cfg.DB)
+		switch dbConn.DriverName() {
+		case "sqlite3":
+			storer = db.NewSQLite(dbConn)
+		case "mysql":
+			storer = db.NewMySQL(dbConn)
+		default:
+			storer = db.NewPostgres(dbConn)
+		}
+	}
+
+	// pprof - see: http://localhost:6060/debug/pprof/
+	if cfg.PprofAddr != "" {
+		go func() {
+			log.Errorf(http.ListenAndServe(cfg.PprofAddr, nil))
+		}()
+	}
+
+	log.Infof("using slack api url %s", cfg.Slack.APIURL)
+	slackClient := slack.New(cfg.Slack.APIToken, slack.OptionDebug(cfg.Slack.Debug))
+	slack.OptionAPIURL(cfg.Slack.APIURL)(slackClient)
+
+	// ctx is the root context of the app, it is cancelled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// set up app
+	app := server.NewApp()
+
+	err = app.Init(ctx, cfg, storer, server.NewSlacker(slackClient), verifier)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- app.Run()
+	}()
 
-	slackAPIURL := os.Getenv("SLACK_API_URL")
-	if slackAPIURL == "" {
-		slackAPIURL = slack.APIURL
+	select {
+	case err = <-runErr:
+		log.Errorf("server stopped: %v", err)
+		stop()
+	case <-ctx.Done():
+		log.Infof("shutting down, waiting up to %s", cfg.ShutdownTimeout)
 	}
 
-	verificationToken := os.Getenv("SLACK_VERIFICATION_TOKEN")
+	// a second signal kills the process rather than waiting for shutdown
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	shutdownErr := app.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Errorf("failed to shut down cleanly: %v", shutdownErr)
+	}
+	if dbConn != nil {
+		if closeErr := dbConn.Close(); closeErr != nil {
+			log.Errorf("failed to close database: %v", closeErr)
+		}
+	}
+	log.Infof("server stopped")
+	// give the console logger a chance to write before exiting
+	log.Close()
+	if err != nil || shutdownErr != nil {
+		os.Exit(1)
+	}
+}
 
-	// set up database
-	dbStr := os.Getenv("DB_CONNECTION_STRING")
-	dbConn, err := util.WaitForDB(dbStr)
+// connectDB connects to the database and brings its schema up to date
+func connectDB(cfg server.DBConfig) *sqlx.DB {
+	driverName, dbStr, err := db.ParseConnectionString(cfg.ConnectionString)
+	if err != nil {
+		log.Fatalf("invalid DB_CONNECTION_STRING: %v", err)
+	}
+	log.Infof("using %s database", driverName)
+	dbConn, err := util.WaitForDB(driverName, dbStr, cfg.ConnectAttempts, cfg.ConnectInterval)
 	if err != nil {
 		timber.Fatal("failed to connect to database" + err.Error())
 	}
-	defer dbConn.Close()
 
 	err = dbConn.Ping()
 	if err != nil {
 		timber.Fatal(err)
 	}
-	postgres := db.NewPostgres(dbConn)
 
-	// pprof - see: http://localhost:6060/debug/pprof/
-	go func() {
-		log.Errorf(http.ListenAndServe(":6060", nil))
-	}()
+	// bring the schema up to date before serving requests
+	migrator, err := db.NewMigrator(dbConn)
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		log.Fatalf("failed to migrate database: %v", err)
+	}
+	log.Infof("applied %d migrations", applied)
+	return dbConn
+}
 
-	log.Infof("using slack api url %s", slackAPIURL)
-	// TODO: make debug toggleable when starting server
-	slackClient := slack.New(slackAPIToken, slack.OptionDebug(true))
-	slack.OptionAPIURL(slackAPIURL)(slackClient)
-	// set up app
-	app := server.NewApp()
+// migrate implements the migrate subcommand, usage:
+//
+//	server migrate up|down [steps]|status
+func migrate(cfg server.DBConfig, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: migrate up|down [steps]|status")
+	}
 
-	err = app.Init(portNum, postgres, slackClient, verificationToken)
+	driverName, dbStr, err := db.ParseConnectionString(cfg.ConnectionString)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatalf("invalid DB_CONNECTION_STRING: %v", err)
+	}
+	dbConn, err := util.WaitForDB(driverName, dbStr, cfg.ConnectAttempts, cfg.ConnectInterval)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
 	}
-	err = app.Run()
+	defer dbConn.Close()
+	migrator, err := db.NewMigrator(dbConn)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		fmt.Printf("applied %d migrations\n", applied)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		fmt.Printf("reverted %d migrations\n", reverted)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-30s %s\n", status.Version, status.Name, applied)
+		}
+	default:
+		log.Fatalf("unknown migrate command %q, expected up, down or status", args[0])
+	}
 }
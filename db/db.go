@@ -1,11 +1,15 @@
 package db
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
-
-	"github.com/jmoiron/sqlx"
+	"fmt"
 )
 
+// ErrUserNotFound is returned when a requested user is not stored
+var ErrUserNotFound = errors.New("user not found")
+
 // User is the database representation of a user
 type User struct {
 	Deleted            bool   `json:"deleted" db:"deleted"`
@@ -16,49 +20,112 @@ type User struct {
 	ProfileStatusText  string `json:"status_text" db:"profile_status_text"`
 	RealName           string `json:"real_name" db:"real_name"`
 	TZ                 string `json:"tz" db:"tz"`
+
+	TeamID            string `json:"team_id" db:"team_id"`
+	TZLabel           string `json:"tz_label" db:"tz_label"`
+	TZOffset          int    `json:"tz_offset" db:"tz_offset"`
+	IsAdmin           bool   `json:"is_admin" db:"is_admin"`
+	IsOwner           bool   `json:"is_owner" db:"is_owner"`
+	IsPrimaryOwner    bool   `json:"is_primary_owner" db:"is_primary_owner"`
+	IsRestricted      bool   `json:"is_restricted" db:"is_restricted"`
+	IsUltraRestricted bool   `json:"is_ultra_restricted" db:"is_ultra_restricted"`
+	IsBot             bool   `json:"is_bot" db:"is_bot"`
+	IsAppUser         bool   `json:"is_app_user" db:"is_app_user"`
+	// Updated is the unix time slack last changed the user
+	Updated int64 `json:"updated" db:"updated"`
+
+	ProfileFirstName             string        `json:"first_name" db:"profile_first_name"`
+	ProfileLastName              string        `json:"last_name" db:"profile_last_name"`
+	ProfileRealNameNormalized    string        `json:"real_name_normalized" db:"profile_real_name_normalized"`
+	ProfileDisplayName           string        `json:"display_name" db:"profile_display_name"`
+	ProfileDisplayNameNormalized string        `json:"display_name_normalized" db:"profile_display_name_normalized"`
+	ProfileEmail                 string        `json:"email" db:"profile_email"`
+	ProfileSkype                 string        `json:"skype" db:"profile_skype"`
+	ProfilePhone                 string        `json:"phone" db:"profile_phone"`
+	ProfileTitle                 string        `json:"title" db:"profile_title"`
+	ProfileImage24               string        `json:"image_24" db:"profile_image_24"`
+	ProfileImage32               string        `json:"image_32" db:"profile_image_32"`
+	ProfileImage48               string        `json:"image_48" db:"profile_image_48"`
+	ProfileImage72               string        `json:"image_72" db:"profile_image_72"`
+	ProfileImage192              string        `json:"image_192" db:"profile_image_192"`
+	ProfileImageOriginal         string        `json:"image_original" db:"profile_image_original"`
+	ProfileStatusExpiration      int           `json:"status_expiration" db:"profile_status_expiration"`
+	ProfileBotID                 string        `json:"bot_id" db:"profile_bot_id"`
+	ProfileAPIAppID              string        `json:"api_app_id" db:"profile_api_app_id"`
+	ProfileTeam                  string        `json:"team" db:"profile_team"`
+	ProfileFields                ProfileFields `json:"fields" db:"profile_fields"`
 }
 
-func NewPostgres(dbConn *sqlx.DB) *Postgres {
-	return &Postgres{dbConn: dbConn}
+// userColumns lists the columns of the users table in the order values are
+// returned by User.values
+const userColumns = `id, name, deleted, real_name, tz, profile_status_text,
+	profile_status_emoji, profile_image_512, team_id, tz_label, tz_offset, is_admin,
+	is_owner, is_primary_owner, is_restricted, is_ultra_restricted, is_bot,
+	is_app_user, updated, profile_first_name, profile_last_name,
+	profile_real_name_normalized, profile_display_name,
+	profile_display_name_normalized, profile_email, profile_skype, profile_phone,
+	profile_title, profile_image_24, profile_image_32, profile_image_48,
+	profile_image_72, profile_image_192, profile_image_original,
+	profile_status_expiration, profile_bot_id, profile_api_app_id, profile_team,
+	profile_fields`
+
+func (u User) values() []interface{} {
+	return []interface{}{u.ID, u.Name, u.Deleted, u.RealName, u.TZ,
+		u.ProfileStatusText, u.ProfileStatusEmoji, u.ProfileImage512, u.TeamID,
+		u.TZLabel, u.TZOffset, u.IsAdmin, u.IsOwner, u.IsPrimaryOwner,
+		u.IsRestricted, u.IsUltraRestricted, u.IsBot, u.IsAppUser, u.Updated,
+		u.ProfileFirstName, u.ProfileLastName, u.ProfileRealNameNormalized,
+		u.ProfileDisplayName, u.ProfileDisplayNameNormalized, u.ProfileEmail,
+		u.ProfileSkype, u.ProfilePhone, u.ProfileTitle, u.ProfileImage24,
+		u.ProfileImage32, u.ProfileImage48, u.ProfileImage72, u.ProfileImage192,
+		u.ProfileImageOriginal, u.ProfileStatusExpiration, u.ProfileBotID,
+		u.ProfileAPIAppID, u.ProfileTeam, u.ProfileFields}
 }
 
-// Postgres implements the Storer interface
-type Postgres struct {
-	dbConn *sqlx.DB
+// ProfileField is a custom profile field defined by a slack workspace
+type ProfileField struct {
+	Value string `json:"value"`
+	Alt   string `json:"alt"`
+	Label string `json:"label"`
 }
 
-func (p *Postgres) CreateUsers(users []User) error {
-	// Want to do an upsert as if the service has been down the db may be stale
-	// ON CONFLICT does not seem to work with sqlx namedexec
-	//_, err := p.dbConn.NamedExec(`INSERT INTO users (id, name, deleted, real_name, tz, profile_status_text, profile_status_emoji, profile_image_512) VALUES (:id, :name, :deleted, :real_name, :tz, :profile_status_text, :profile_status_emoji, :profile_image_512) ON CONFLICT (id) DO UPDATE SET name=:name, deleted=:deleted, real_name=:real_name, tz=:tz, profile_status_text=:profile_status_text, profile_status_emoji=:profile_status_emoji, profile_image_512=:profile_image_512`, users)
-	tx, err := p.dbConn.Beginx() // put multiple inserts in transaction to speed up
-	if err != nil {
-		return err
+// ProfileFields maps custom profile field ids to their values, it is stored
+// as a json document
+type ProfileFields map[string]ProfileField
+
+// Value implements driver.Valuer
+func (f ProfileFields) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return "{}", nil
 	}
-	for _, user := range users {
-		_, err = tx.Exec(`INSERT INTO users VALUES ($1,$2,$3,$4,$5,$6,$7,$8) ON CONFLICT (id) DO UPDATE SET name=$9, deleted=$10, real_name=$11, tz=$12, profile_status_text=$13, profile_status_emoji=$14, profile_image_512=$15`,
-			user.ID, user.Name, user.Deleted, user.RealName, user.TZ, user.ProfileStatusText, user.ProfileStatusEmoji, user.ProfileImage512, user.Name, user.Deleted, user.RealName, user.TZ, user.ProfileStatusText, user.ProfileStatusEmoji, user.ProfileImage512)
-		if err != nil {
-			rollbackErr := tx.Rollback()
-			if rollbackErr != nil {
-				err = errors.New(err.Error() + ":" + rollbackErr.Error())
-			}
-			return err
-		}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
 	}
-	err = tx.Commit()
-	return err
-}
-
-func (p *Postgres) UpdateUser(user User) error {
-	return p.CreateUsers([]User{user})
+	return string(b), nil
 }
 
-// may need pagination here
-func (p *Postgres) GetAllUsers() ([]User, error) {
-	var users []User
-	// if database gets significantly large then we may not want to load all
-	// users into memory at once
-	err := p.dbConn.Select(&users, "SELECT * FROM users ORDER BY id")
-	return users, err
+// Scan implements sql.Scanner, an empty document scans to a nil map
+func (f *ProfileFields) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*f = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into ProfileFields", src)
+	}
+	var fields ProfileFields
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		fields = nil
+	}
+	*f = fields
+	return nil
 }
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Source describes what caused a user to be written
+type Source string
+
+const (
+	// SourceInitialSync is a write from fetching all users from the slack api
+	// at startup
+	SourceInitialSync Source = "initial_sync"
+	// SourceWebhook is a write from an event received on the webhooks endpoint
+	SourceWebhook Source = "webhook"
+	// SourceResync is a write from periodically reconciling users with slack
+	SourceResync Source = "resync"
+)
+
+// Origin describes why users are being written, it is recorded alongside
+// every change in user history
+type Origin struct {
+	Source Source
+	// EventID is the slack event id for webhook writes, otherwise empty
+	EventID string
+	// EventTime is the slack event_time, in unix seconds, for webhook writes
+	// otherwise zero
+	EventTime int64
+}
+
+// ErrStaleUser is returned when writing a user which is older than the one
+// stored, e.g. from a webhook delivered out of order
+var ErrStaleUser = errors.New("stored user is newer")
+
+// isStale reports whether writing user would overwrite a newer stored user.
+// Slack bumps updated whenever a user changes and event times order events for
+// the same revision. Writes which are not from events only compare updated so
+// a resync can correct data whose updated did not change
+func isStale(stored User, storedEventTime int64, user User, origin Origin) bool {
+	if user.Updated != stored.Updated {
+		return user.Updated < stored.Updated
+	}
+	return origin.EventTime != 0 && origin.EventTime < storedEventTime
+}
+
+// UserChange is a recorded change to a user. Old is nil when the change
+// created the user
+type UserChange struct {
+	ID        int64     `json:"id"`
+	UserID    string    `json:"user_id"`
+	Source    Source    `json:"source"`
+	EventID   string    `json:"event_id"`
+	Old       *User     `json:"old"`
+	New       *User     `json:"new"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// FieldChange is the before and after value of a single user field
+type FieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// Fields returns the fields which differ between the old and new user, named
+// by their json keys
+func (c UserChange) Fields() []FieldChange {
+	var before, after reflect.Value
+	if c.Old != nil {
+		before = reflect.ValueOf(*c.Old)
+	}
+	if c.New != nil {
+		after = reflect.ValueOf(*c.New)
+	}
+
+	var changes []FieldChange
+	userType := reflect.TypeOf(User{})
+	for i := 0; i < userType.NumField(); i++ {
+		var oldValue, newValue interface{}
+		if before.IsValid() {
+			oldValue = before.Field(i).Interface()
+		}
+		if after.IsValid() {
+			newValue = after.Field(i).Interface()
+		}
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		name := strings.Split(userType.Field(i).Tag.Get("json"), ",")[0]
+		changes = append(changes, FieldChange{Field: name, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+// Equal reports whether two users hold the same data, an empty set of custom
+// fields is equal to a nil one
+func (u User) Equal(o User) bool {
+	if len(u.ProfileFields) != len(o.ProfileFields) {
+		return false
+	}
+	for id, f := range u.ProfileFields {
+		if of, ok := o.ProfileFields[id]; !ok || of != f {
+			return false
+		}
+	}
+	u.ProfileFields, o.ProfileFields = nil, nil
+	return reflect.DeepEqual(u, o)
+}
+
+// userChangeRow is the database representation of a UserChange, users are
+// stored as json documents
+type userChangeRow struct {
+	ID        int64          `db:"id"`
+	UserID    string         `db:"user_id"`
+	Source    string         `db:"source"`
+	EventID   string         `db:"event_id"`
+	OldValue  sql.NullString `db:"old_value"`
+	NewValue  string         `db:"new_value"`
+	ChangedAt time.Time      `db:"changed_at"`
+}
+
+func (r userChangeRow) toChange() (UserChange, error) {
+	change := UserChange{
+		ID:        r.ID,
+		UserID:    r.UserID,
+		Source:    Source(r.Source),
+		EventID:   r.EventID,
+		ChangedAt: r.ChangedAt,
+		New:       &User{},
+	}
+	if r.OldValue.Valid {
+		change.Old = &User{}
+		if err := json.Unmarshal([]byte(r.OldValue.String), change.Old); err != nil {
+			return change, err
+		}
+	}
+	err := json.Unmarshal([]byte(r.NewValue), change.New)
+	return change, err
+}
+
+// historyValues returns the old_value and new_value columns for a change
+func historyValues(before *User, after User) (interface{}, string, error) {
+	var oldValue interface{}
+	if before != nil {
+		b, err := json.Marshal(before)
+		if err != nil {
+			return nil, "", err
+		}
+		oldValue = string(b)
+	}
+	b, err := json.Marshal(after)
+	return oldValue, string(b), err
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"time"
+)
+
+// InboxEvent is a raw webhook payload saved before it is processed, so that
+// it can be replayed if the service stops before processing it
+type InboxEvent struct {
+	ID int64
+	// EventID is the slack event id, it may be empty
+	EventID    string
+	Payload    []byte
+	ReceivedAt time.Time
+}
+
+// inboxRow is the database representation of an InboxEvent
+type inboxRow struct {
+	ID         int64  `db:"id"`
+	EventID    string `db:"event_id"`
+	Payload    string `db:"payload"`
+	ReceivedAt int64  `db:"received_at"`
+}
+
+func (r inboxRow) toEvent() InboxEvent {
+	return InboxEvent{ID: r.ID, EventID: r.EventID, Payload: []byte(r.Payload),
+		ReceivedAt: time.UnixMilli(r.ReceivedAt).UTC()}
+}
@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:      make(map[string]User),
+		eventTimes: make(map[string]int64),
+		history:    make(map[string][]UserChange),
+		events:     make(map[string]time.Time),
+		inbox:      make(map[int64]*memoryInboxEvent),
+	}
+}
+
+// Memory implements the Storer interface without a database, it is intended
+// for local development and tests as nothing is persisted
+type Memory struct {
+	mu sync.RWMutex
+	// ids holds the keys of users in sorted order for pagination
+	ids   []string
+	users map[string]User
+	// eventTimes holds the event_time of the webhook which last wrote a user
+	eventTimes map[string]int64
+	history    map[string][]UserChange
+	// events maps claimed webhook event ids to when their claim expires
+	events map[string]time.Time
+	inbox  map[int64]*memoryInboxEvent
+	// lastInboxID is the id of the most recently saved inbox event
+	lastInboxID int64
+	// lastChangeID is the id of the most recent UserChange
+	lastChangeID int64
+}
+
+// CreateUsers upserts users, recording a change in user history for every
+// user which is created or whose data changes, and returns how many were. If
+// a user appears more than once only its last entry is written. Users older
+// than those stored are skipped
+func (m *Memory) CreateUsers(users []User, origin Origin) (int, error) {
+	written, _ := m.createUsers(users, origin)
+	return written, nil
+}
+
+// createUsers implements CreateUsers and also returns how many users were
+// skipped for being stale
+func (m *Memory) createUsers(users []User, origin Origin) (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var written, stale int
+	for _, user := range lastByID(users) {
+		user = copyUser(user)
+		var old *User
+		if existing, ok := m.users[user.ID]; ok {
+			if isStale(existing, m.eventTimes[user.ID], user, origin) {
+				stale++
+				continue
+			}
+			if existing.Equal(user) {
+				continue // nothing changed so there is no history to record
+			}
+			old = &existing
+		} else {
+			i := sort.SearchStrings(m.ids, user.ID)
+			m.ids = append(m.ids, "")
+			copy(m.ids[i+1:], m.ids[i:])
+			m.ids[i] = user.ID
+		}
+		m.users[user.ID] = user
+		if origin.EventTime > m.eventTimes[user.ID] {
+			m.eventTimes[user.ID] = origin.EventTime
+		}
+		written++
+
+		m.lastChangeID++
+		newUser := user
+		m.history[user.ID] = append(m.history[user.ID], UserChange{
+			ID:        m.lastChangeID,
+			UserID:    user.ID,
+			Source:    origin.Source,
+			EventID:   origin.EventID,
+			Old:       old,
+			New:       &newUser,
+			ChangedAt: time.Now().UTC(),
+		})
+	}
+	return written, stale
+}
+
+// UpdateUser upserts a user and reports whether it was created or changed, it
+// returns ErrStaleUser if the stored user is newer
+func (m *Memory) UpdateUser(user User, origin Origin) (bool, error) {
+	written, stale := m.createUsers([]User{user}, origin)
+	if stale > 0 {
+		return false, ErrStaleUser
+	}
+	return written > 0, nil
+}
+
+// ClaimEvent records that a webhook event has been processed until expires,
+// it reports false if the event already had been
+func (m *Memory) ClaimEvent(eventID string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, e := range m.events {
+		if !e.After(now) {
+			delete(m.events, id)
+		}
+	}
+	if _, ok := m.events[eventID]; ok {
+		return false, nil
+	}
+	m.events[eventID] = expires
+	return true, nil
+}
+
+// memoryInboxEvent is an InboxEvent along with when it was processed
+type memoryInboxEvent struct {
+	InboxEvent
+	processedAt time.Time
+}
+
+// SaveEvent saves a raw webhook payload to the inbox and returns its id
+func (m *Memory) SaveEvent(eventID string, payload []byte) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastInboxID++
+	m.inbox[m.lastInboxID] = &memoryInboxEvent{InboxEvent: InboxEvent{
+		ID:         m.lastInboxID,
+		EventID:    eventID,
+		Payload:    append([]byte(nil), payload...),
+		ReceivedAt: time.Now().UTC(),
+	}}
+	return m.lastInboxID, nil
+}
+
+// CompleteEvent marks an inbox event as processed
+func (m *Memory) CompleteEvent(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.inbox[id]; ok {
+		e.processedAt = time.Now()
+	}
+	return nil
+}
+
+// PendingEvents returns the inbox events which have not been processed,
+// oldest first
+func (m *Memory) PendingEvents() ([]InboxEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := []InboxEvent{}
+	for _, e := range m.inbox {
+		if e.processedAt.IsZero() {
+			events = append(events, e.InboxEvent)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// PruneEvents deletes inbox events which were processed before the given
+// time and returns how many were deleted
+func (m *Memory) PruneEvents(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pruned int
+	for id, e := range m.inbox {
+		if !e.processedAt.IsZero() && e.processedAt.Before(before) {
+			delete(m.inbox, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// GetUsersPage returns up to limit users ordered by id starting from the
+// position given by an encoded cursor, an empty cursor fetches the first page
+func (m *Memory) GetUsersPage(cursor string, limit int) (Page, error) {
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return Page{}, err
+	}
+	limit = ClampPageSize(limit)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// fetch one extra row to find out whether there is a further page, rows
+	// are collected in the direction of the cursor as NewPage expects
+	var users []User
+	if c.Before {
+		for i := sort.SearchStrings(m.ids, c.ID) - 1; i >= 0 && len(users) <= limit; i-- {
+			users = append(users, copyUser(m.users[m.ids[i]]))
+		}
+	} else {
+		start := sort.SearchStrings(m.ids, c.ID)
+		if start < len(m.ids) && m.ids[start] == c.ID {
+			start++
+		}
+		for i := start; i < len(m.ids) && len(users) <= limit; i++ {
+			users = append(users, copyUser(m.users[m.ids[i]]))
+		}
+	}
+	return NewPage(users, c, limit), nil
+}
+
+// GetUser returns the user with the given id or ErrUserNotFound
+func (m *Memory) GetUser(id string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+// CountUsers returns how many users are stored and how many of those are
+// deleted
+func (m *Memory) CountUsers() (int, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deleted int
+	for _, user := range m.users {
+		if user.Deleted {
+			deleted++
+		}
+	}
+	return len(m.users), deleted, nil
+}
+
+// Ping always succeeds as there is nothing to connect to
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// GetUserHistory returns the recorded changes to a user, most recent first,
+// or ErrUserNotFound if the user has never been stored
+func (m *Memory) GetUserHistory(id string) ([]UserChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.users[id]; !ok {
+		return nil, ErrUserNotFound
+	}
+	history := m.history[id]
+	changes := make([]UserChange, len(history))
+	for i, change := range history {
+		changes[len(history)-1-i] = change
+	}
+	return changes, nil
+}
+
+// copyUser returns a copy of a user which shares no memory with the original
+// so callers cannot mutate stored users, empty custom fields are stored as nil
+// as they are by the databases
+func copyUser(u User) User {
+	if len(u.ProfileFields) == 0 {
+		u.ProfileFields = nil
+		return u
+	}
+	fields := make(ProfileFields, len(u.ProfileFields))
+	for id, f := range u.ProfileFields {
+		fields[id] = f
+	}
+	u.ProfileFields = fields
+	return u
+}
@@ -0,0 +1,15 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/db/storertest"
+	"github.com/aultimus/slack-user-data-service/server"
+)
+
+func TestMemory(t *testing.T) {
+	storertest.RunStorerTests(t, func(t *testing.T) server.Storer {
+		return db.NewMemory()
+	})
+}
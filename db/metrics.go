@@ -0,0 +1,20 @@
+package db
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Latency of storage operations by database driver and operation.",
+	Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+}, []string{"driver", "operation"})
+
+// observe records the latency of a storage operation which started at start,
+// call it deferred
+func (s *sqlStore) observe(operation string, start time.Time) {
+	queryDuration.WithLabelValues(s.dbConn.DriverName(), operation).Observe(time.Since(start).Seconds())
+}
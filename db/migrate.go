@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/cocoonlife/timber"
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationFiles holds the schema migrations for each supported database,
+// files are named <version>_<name>.<up|down>.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// dialect holds the database specific parts of running migrations
+type dialect struct {
+	// dir is the directory of migrationFiles holding the dialect's migrations
+	dir string
+	// lockSQL is run at the start of every migration transaction to serialise
+	// concurrent migrators, e.g. several replicas starting at once
+	lockSQL string
+	// unlockSQL releases lockSQL, it is set for databases whose locks belong
+	// to the session rather than the transaction. The lock is then taken
+	// before the transaction begins and released once it has ended
+	unlockSQL string
+}
+
+var dialects = map[string]dialect{
+	// the lock key is arbitrary but must be shared by all migrators
+	"postgres": {dir: "postgres", lockSQL: "SELECT pg_advisory_xact_lock(4242424242)"},
+	// sqlite write transactions lock the whole database so need no lock
+	"sqlite3": {dir: "sqlite"},
+	// mysql commits implicitly on every schema change so the lock must outlive
+	// the transaction
+	"mysql": {dir: "mysql", lockSQL: "SELECT GET_LOCK('schema_migrations', 60)",
+		unlockSQL: "SELECT RELEASE_LOCK('schema_migrations')"},
+}
+
+const createMigrationsTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version     INTEGER PRIMARY KEY NOT NULL,
+    name        TEXT NOT NULL,
+    applied_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// Migrator applies the embedded schema migrations to a database, applied
+// versions are tracked in the schema_migrations table
+type Migrator struct {
+	dbConn     *sqlx.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the database dbConn is connected to
+func NewMigrator(dbConn *sqlx.DB) (*Migrator, error) {
+	d, ok := dialects[dbConn.DriverName()]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for database driver %s", dbConn.DriverName())
+	}
+	dir, err := fs.Sub(migrationFiles, path.Join("migrations", d.dir))
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := parseMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{dbConn: dbConn, dialect: d, migrations: migrations}, nil
+}
+
+// parseMigrations reads migrations from the root of fsys ordered by version
+func parseMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		matches := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("unexpected migration file name %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(matches[1])
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s",
+				version, m.Name, matches[2])
+		}
+		if matches[3] == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file",
+				m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies every migration which has not yet been applied, in order of
+// version, and returns how many were applied
+func (m *Migrator) Up() (int, error) {
+	if err := m.ensureMigrationsTable(); err != nil {
+		return 0, err
+	}
+	var applied int
+	for _, migration := range m.migrations {
+		ran, err := m.apply(migration, true)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		if ran {
+			log.Infof("applied migration %d_%s", migration.Version, migration.Name)
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// Down reverts up to steps of the most recently applied migrations and
+// returns how many were reverted
+func (m *Migrator) Down(steps int) (int, error) {
+	if err := m.ensureMigrationsTable(); err != nil {
+		return 0, err
+	}
+	var reverted int
+	for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+		migration := m.migrations[i]
+		ran, err := m.apply(migration, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		if ran {
+			log.Infof("reverted migration %d_%s", migration.Version, migration.Name)
+			reverted++
+		}
+	}
+	return reverted, nil
+}
+
+// Status lists every known migration and whether it has been applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	if err := m.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	err := m.dbConn.Select(&rows, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	appliedAt := make(map[int]time.Time, len(rows))
+	for _, row := range rows {
+		appliedAt[row.Version] = row.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		at, applied := appliedAt[migration.Version]
+		statuses[i] = MigrationStatus{Migration: migration, Applied: applied, AppliedAt: at}
+		delete(appliedAt, migration.Version)
+	}
+	for version := range appliedAt {
+		log.Warnf("migration %d is applied but unknown to this build", version)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) ensureMigrationsTable() error {
+	return m.inTx(func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(createMigrationsTableSQL)
+		return err
+	})
+}
+
+// apply runs a migration in the given direction unless it has already been
+// run, it returns whether the migration ran
+func (m *Migrator) apply(migration Migration, up bool) (bool, error) {
+	var ran bool
+	err := m.inTx(func(tx *sqlx.Tx) error {
+		var count int
+		err := tx.Get(&count, tx.Rebind("SELECT COUNT(*) FROM schema_migrations WHERE version=?"),
+			migration.Version)
+		if err != nil {
+			return err
+		}
+		if applied := count > 0; applied == up {
+			return nil // nothing to do
+		}
+
+		if up {
+			if _, err = tx.Exec(migration.Up); err != nil {
+				return err
+			}
+			_, err = tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"),
+				migration.Version, migration.Name)
+		} else {
+			if _, err = tx.Exec(migration.Down); err != nil {
+				return err
+			}
+			_, err = tx.Exec(tx.Rebind("DELETE FROM schema_migrations WHERE version=?"),
+				migration.Version)
+		}
+		ran = err == nil
+		return err
+	})
+	return ran, err
+}
+
+// inTx runs f in a transaction holding the dialect's migration lock
+func (m *Migrator) inTx(f func(tx *sqlx.Tx) error) error {
+	ctx := context.Background()
+	conn, err := m.dbConn.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if m.dialect.unlockSQL != "" {
+		// session locks return 1 once acquired and 0 on timing out
+		var locked int
+		if err = conn.GetContext(ctx, &locked, m.dialect.lockSQL); err != nil {
+			return err
+		}
+		if locked != 1 {
+			return errors.New("timed out waiting for the migration lock")
+		}
+		defer func() {
+			if _, err := conn.ExecContext(ctx, m.dialect.unlockSQL); err != nil {
+				log.Errorf("failed to release migration lock: %v", err)
+			}
+		}()
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if m.dialect.lockSQL != "" && m.dialect.unlockSQL == "" {
+		if _, err = tx.Exec(m.dialect.lockSQL); err != nil {
+			return rollback(tx, err)
+		}
+	}
+	if err = f(tx); err != nil {
+		return rollback(tx, err)
+	}
+	return tx.Commit()
+}
+
+// rollback rolls tx back and returns err, wrapped so that callers can still
+// match it if the rollback fails too
+func rollback(tx *sqlx.Tx, err error) error {
+	rollbackErr := tx.Rollback()
+	if rollbackErr != nil {
+		err = fmt.Errorf("%w: rollback: %v", err, rollbackErr)
+	}
+	return err
+}
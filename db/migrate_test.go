@@ -0,0 +1,78 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMigrations(t *testing.T) {
+	a := assert.New(t)
+
+	migrations, err := parseMigrations(fstest.MapFS{
+		"0002_add_column.up.sql":     {Data: []byte("ALTER TABLE foo ADD COLUMN bar TEXT;")},
+		"0002_add_column.down.sql":   {Data: []byte("ALTER TABLE foo DROP COLUMN bar;")},
+		"0001_create_table.up.sql":   {Data: []byte("CREATE TABLE foo (id TEXT);")},
+		"0001_create_table.down.sql": {Data: []byte("DROP TABLE foo;")},
+	})
+	a.NoError(err)
+	a.Equal([]Migration{
+		{Version: 1, Name: "create_table", Up: "CREATE TABLE foo (id TEXT);", Down: "DROP TABLE foo;"},
+		{Version: 2, Name: "add_column", Up: "ALTER TABLE foo ADD COLUMN bar TEXT;", Down: "ALTER TABLE foo DROP COLUMN bar;"},
+	}, migrations)
+
+	_, err = parseMigrations(fstest.MapFS{
+		"0001_create_table.up.sql": {Data: []byte("CREATE TABLE foo (id TEXT);")},
+	})
+	a.Error(err, "missing down migration")
+
+	_, err = parseMigrations(fstest.MapFS{
+		"0001_create_table.up.sql": {Data: []byte("CREATE TABLE foo (id TEXT);")},
+		"0001_other_name.down.sql": {Data: []byte("DROP TABLE foo;")},
+	})
+	a.Error(err, "conflicting names")
+
+	_, err = parseMigrations(fstest.MapFS{"schema.sql": {Data: []byte("")}})
+	a.Error(err, "unexpected file name")
+}
+
+// TestEmbeddedMigrations checks the migrations shipped for each database are
+// well formed and numbered without gaps
+func TestEmbeddedMigrations(t *testing.T) {
+	a := assert.New(t)
+	for driverName := range dialects {
+		m, err := NewMigrator(sqlx.NewDb(nil, driverName))
+		a.NoError(err, driverName)
+		a.NotEmpty(m.migrations, driverName)
+		for i, migration := range m.migrations {
+			a.Equal(i+1, migration.Version, driverName)
+		}
+	}
+
+	_, err := NewMigrator(sqlx.NewDb(nil, "oracle"))
+	a.Error(err)
+}
+
+// TestRollbackKeepsError checks the error a transaction is rolled back for can
+// still be matched when the rollback fails, the retry of concurrent creates
+// depends on it
+func TestRollbackKeepsError(t *testing.T) {
+	a := assert.New(t)
+	dbConn, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbConn.Close()
+
+	tx, err := dbConn.Beginx()
+	a.NoError(err)
+	a.True(errors.Is(rollback(tx, ErrConcurrentCreate), ErrConcurrentCreate))
+
+	// a transaction which is already done fails to roll back
+	err = rollback(tx, ErrConcurrentCreate)
+	a.True(errors.Is(err, ErrConcurrentCreate), err)
+	a.Contains(err.Error(), "rollback:")
+}
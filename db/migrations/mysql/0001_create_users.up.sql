@@ -0,0 +1,11 @@
+-- ids are compared byte-wise so users page in the same order as on postgres
+CREATE TABLE IF NOT EXISTS users (
+    id                      VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin PRIMARY KEY NOT NULL,
+    name                    TEXT,
+    deleted                 BOOLEAN NOT NULL,
+    real_name               TEXT,
+    tz                      TEXT,
+    profile_status_text     TEXT,
+    profile_status_emoji    TEXT,
+    profile_image_512       TEXT
+);
@@ -0,0 +1,32 @@
+ALTER TABLE users
+    DROP COLUMN team_id,
+    DROP COLUMN tz_label,
+    DROP COLUMN tz_offset,
+    DROP COLUMN is_admin,
+    DROP COLUMN is_owner,
+    DROP COLUMN is_primary_owner,
+    DROP COLUMN is_restricted,
+    DROP COLUMN is_ultra_restricted,
+    DROP COLUMN is_bot,
+    DROP COLUMN is_app_user,
+    DROP COLUMN updated,
+    DROP COLUMN profile_first_name,
+    DROP COLUMN profile_last_name,
+    DROP COLUMN profile_real_name_normalized,
+    DROP COLUMN profile_display_name,
+    DROP COLUMN profile_display_name_normalized,
+    DROP COLUMN profile_email,
+    DROP COLUMN profile_skype,
+    DROP COLUMN profile_phone,
+    DROP COLUMN profile_title,
+    DROP COLUMN profile_image_24,
+    DROP COLUMN profile_image_32,
+    DROP COLUMN profile_image_48,
+    DROP COLUMN profile_image_72,
+    DROP COLUMN profile_image_192,
+    DROP COLUMN profile_image_original,
+    DROP COLUMN profile_status_expiration,
+    DROP COLUMN profile_bot_id,
+    DROP COLUMN profile_api_app_id,
+    DROP COLUMN profile_team,
+    DROP COLUMN profile_fields;
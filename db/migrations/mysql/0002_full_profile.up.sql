@@ -0,0 +1,35 @@
+-- carry the full slack user profile, columns have defaults so existing rows
+-- remain valid. TEXT and JSON defaults must be expressions, which needs mysql
+-- 8.0.13 or later
+ALTER TABLE users
+    ADD COLUMN team_id                         TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN tz_label                        TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN tz_offset                       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN is_admin                        BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN is_owner                        BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN is_primary_owner                BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN is_restricted                   BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN is_ultra_restricted             BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN is_bot                          BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN is_app_user                     BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN updated                         BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN profile_first_name              TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_last_name               TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_real_name_normalized    TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_display_name            TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_display_name_normalized TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_email                   TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_skype                   TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_phone                   TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_title                   TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_image_24                TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_image_32                TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_image_48                TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_image_72                TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_image_192               TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_image_original          TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_status_expiration       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN profile_bot_id                  TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_api_app_id              TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_team                    TEXT NOT NULL DEFAULT (''),
+    ADD COLUMN profile_fields                  JSON NOT NULL DEFAULT ('{}');
@@ -0,0 +1,12 @@
+-- every change to a user is recorded here, rows are never updated. There is no
+-- foreign key to users so history outlives the user row
+CREATE TABLE IF NOT EXISTS user_history (
+    id          BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id     VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+    source      TEXT NOT NULL,
+    event_id    VARCHAR(255) NOT NULL DEFAULT '',
+    old_value   JSON,
+    new_value   JSON NOT NULL,
+    changed_at  TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX user_history_user_id_idx (user_id, id)
+);
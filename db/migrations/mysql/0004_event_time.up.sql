@@ -0,0 +1,3 @@
+-- the event_time of the webhook which last wrote a user, used with updated to
+-- reject events delivered out of order. Writes not from events leave it as is
+ALTER TABLE users ADD COLUMN event_time BIGINT NOT NULL DEFAULT 0;
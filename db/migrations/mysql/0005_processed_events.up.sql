@@ -0,0 +1,7 @@
+-- ids of webhook events which have been processed, so slack's retries of them
+-- can be skipped. expires_at is in unix milliseconds
+CREATE TABLE IF NOT EXISTS processed_events (
+    id          VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin PRIMARY KEY NOT NULL,
+    expires_at  BIGINT NOT NULL,
+    INDEX processed_events_expires_at_idx (expires_at)
+);
@@ -0,0 +1,11 @@
+-- raw webhook payloads are saved here before slack is acknowledged, and marked
+-- processed once written to users. Unprocessed events are replayed on startup.
+-- Times are in unix milliseconds
+CREATE TABLE IF NOT EXISTS events_inbox (
+    id            BIGINT AUTO_INCREMENT PRIMARY KEY,
+    event_id      VARCHAR(255) NOT NULL DEFAULT '',
+    payload       MEDIUMTEXT NOT NULL,
+    received_at   BIGINT NOT NULL,
+    processed_at  BIGINT,
+    INDEX events_inbox_processed_at_idx (processed_at, id)
+);
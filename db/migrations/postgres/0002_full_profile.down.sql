@@ -0,0 +1,32 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS team_id,
+    DROP COLUMN IF EXISTS tz_label,
+    DROP COLUMN IF EXISTS tz_offset,
+    DROP COLUMN IF EXISTS is_admin,
+    DROP COLUMN IF EXISTS is_owner,
+    DROP COLUMN IF EXISTS is_primary_owner,
+    DROP COLUMN IF EXISTS is_restricted,
+    DROP COLUMN IF EXISTS is_ultra_restricted,
+    DROP COLUMN IF EXISTS is_bot,
+    DROP COLUMN IF EXISTS is_app_user,
+    DROP COLUMN IF EXISTS updated,
+    DROP COLUMN IF EXISTS profile_first_name,
+    DROP COLUMN IF EXISTS profile_last_name,
+    DROP COLUMN IF EXISTS profile_real_name_normalized,
+    DROP COLUMN IF EXISTS profile_display_name,
+    DROP COLUMN IF EXISTS profile_display_name_normalized,
+    DROP COLUMN IF EXISTS profile_email,
+    DROP COLUMN IF EXISTS profile_skype,
+    DROP COLUMN IF EXISTS profile_phone,
+    DROP COLUMN IF EXISTS profile_title,
+    DROP COLUMN IF EXISTS profile_image_24,
+    DROP COLUMN IF EXISTS profile_image_32,
+    DROP COLUMN IF EXISTS profile_image_48,
+    DROP COLUMN IF EXISTS profile_image_72,
+    DROP COLUMN IF EXISTS profile_image_192,
+    DROP COLUMN IF EXISTS profile_image_original,
+    DROP COLUMN IF EXISTS profile_status_expiration,
+    DROP COLUMN IF EXISTS profile_bot_id,
+    DROP COLUMN IF EXISTS profile_api_app_id,
+    DROP COLUMN IF EXISTS profile_team,
+    DROP COLUMN IF EXISTS profile_fields;
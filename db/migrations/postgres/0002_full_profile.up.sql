@@ -0,0 +1,34 @@
+-- carry the full slack user profile, columns have defaults so existing rows
+-- remain valid
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS team_id                         TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tz_label                        TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tz_offset                       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS is_admin                        BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS is_owner                        BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS is_primary_owner                BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS is_restricted                   BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS is_ultra_restricted             BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS is_bot                          BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS is_app_user                     BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS updated                         BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS profile_first_name              TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_last_name               TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_real_name_normalized    TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_display_name            TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_display_name_normalized TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_email                   TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_skype                   TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_phone                   TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_title                   TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_image_24                TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_image_32                TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_image_48                TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_image_72                TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_image_192               TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_image_original          TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_status_expiration       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS profile_bot_id                  TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_api_app_id              TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_team                    TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS profile_fields                  JSONB NOT NULL DEFAULT '{}';
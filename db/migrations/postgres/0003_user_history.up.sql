@@ -0,0 +1,12 @@
+-- every change to a user is recorded here, rows are never updated. There is no
+-- foreign key to users so history outlives the user row
+CREATE TABLE IF NOT EXISTS user_history (
+    id          BIGSERIAL PRIMARY KEY,
+    user_id     TEXT NOT NULL,
+    source      TEXT NOT NULL,
+    event_id    TEXT NOT NULL DEFAULT '',
+    old_value   JSONB,
+    new_value   JSONB NOT NULL,
+    changed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS user_history_user_id_idx ON user_history (user_id, id);
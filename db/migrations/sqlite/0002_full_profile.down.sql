@@ -0,0 +1,31 @@
+ALTER TABLE users DROP COLUMN team_id;
+ALTER TABLE users DROP COLUMN tz_label;
+ALTER TABLE users DROP COLUMN tz_offset;
+ALTER TABLE users DROP COLUMN is_admin;
+ALTER TABLE users DROP COLUMN is_owner;
+ALTER TABLE users DROP COLUMN is_primary_owner;
+ALTER TABLE users DROP COLUMN is_restricted;
+ALTER TABLE users DROP COLUMN is_ultra_restricted;
+ALTER TABLE users DROP COLUMN is_bot;
+ALTER TABLE users DROP COLUMN is_app_user;
+ALTER TABLE users DROP COLUMN updated;
+ALTER TABLE users DROP COLUMN profile_first_name;
+ALTER TABLE users DROP COLUMN profile_last_name;
+ALTER TABLE users DROP COLUMN profile_real_name_normalized;
+ALTER TABLE users DROP COLUMN profile_display_name;
+ALTER TABLE users DROP COLUMN profile_display_name_normalized;
+ALTER TABLE users DROP COLUMN profile_email;
+ALTER TABLE users DROP COLUMN profile_skype;
+ALTER TABLE users DROP COLUMN profile_phone;
+ALTER TABLE users DROP COLUMN profile_title;
+ALTER TABLE users DROP COLUMN profile_image_24;
+ALTER TABLE users DROP COLUMN profile_image_32;
+ALTER TABLE users DROP COLUMN profile_image_48;
+ALTER TABLE users DROP COLUMN profile_image_72;
+ALTER TABLE users DROP COLUMN profile_image_192;
+ALTER TABLE users DROP COLUMN profile_image_original;
+ALTER TABLE users DROP COLUMN profile_status_expiration;
+ALTER TABLE users DROP COLUMN profile_bot_id;
+ALTER TABLE users DROP COLUMN profile_api_app_id;
+ALTER TABLE users DROP COLUMN profile_team;
+ALTER TABLE users DROP COLUMN profile_fields;
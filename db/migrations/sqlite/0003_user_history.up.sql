@@ -0,0 +1,12 @@
+-- every change to a user is recorded here, rows are never updated. There is no
+-- foreign key to users so history outlives the user row
+CREATE TABLE IF NOT EXISTS user_history (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id     TEXT NOT NULL,
+    source      TEXT NOT NULL,
+    event_id    TEXT NOT NULL DEFAULT '',
+    old_value   TEXT,
+    new_value   TEXT NOT NULL,
+    changed_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS user_history_user_id_idx ON user_history (user_id, id);
@@ -0,0 +1,7 @@
+-- ids of webhook events which have been processed, so slack's retries of them
+-- can be skipped. expires_at is in unix milliseconds
+CREATE TABLE IF NOT EXISTS processed_events (
+    id          TEXT PRIMARY KEY NOT NULL,
+    expires_at  BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS processed_events_expires_at_idx ON processed_events (expires_at);
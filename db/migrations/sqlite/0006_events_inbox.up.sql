@@ -0,0 +1,11 @@
+-- raw webhook payloads are saved here before slack is acknowledged, and marked
+-- processed once written to users. Unprocessed events are replayed on startup.
+-- Times are in unix milliseconds
+CREATE TABLE IF NOT EXISTS events_inbox (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_id      TEXT NOT NULL DEFAULT '',
+    payload       TEXT NOT NULL,
+    received_at   BIGINT NOT NULL,
+    processed_at  BIGINT
+);
+CREATE INDEX IF NOT EXISTS events_inbox_pending_idx ON events_inbox (id) WHERE processed_at IS NULL;
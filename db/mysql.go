@@ -0,0 +1,46 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// NewMySQL returns a MySQL store, dbConn must be opened with a data source
+// name from ParseConnectionString
+func NewMySQL(dbConn *sqlx.DB) *MySQL {
+	s := newSQLStore(dbConn, " FOR UPDATE", onDuplicateKeyIgnoreSQL, onDuplicateKeyUpdateSQL)
+	// under the default repeatable read, locking a user which does not exist
+	// yet takes a gap lock which deadlocks writers racing to create it
+	s.txOptions = &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+	return &MySQL{sqlStore: s}
+}
+
+// MySQL implements the Storer interface
+type MySQL struct {
+	sqlStore
+}
+
+// onDuplicateKeyUpdateSQL uses VALUES() rather than a row alias to support
+// mysql before 8.0.19
+var onDuplicateKeyUpdateSQL = "ON DUPLICATE KEY UPDATE " + assignUserColumns("%[1]s=VALUES(%[1]s)")
+
+// onDuplicateKeyIgnoreSQL leaves existing users untouched, the no-op update
+// leaves no rows affected. INSERT IGNORE is avoided as it also ignores errors
+// such as truncated values
+const onDuplicateKeyIgnoreSQL = "ON DUPLICATE KEY UPDATE id=id"
+
+// parseMySQLConnectionString returns a go-sql-driver data source name which
+// parses timestamps and allows the multi statement migrations to run
+func parseMySQLConnectionString(dsn string) (string, string, error) {
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	config.ParseTime = true
+	config.MultiStatements = true
+	// onDuplicateKeyIgnoreSQL relies on unchanged rows not being counted
+	config.ClientFoundRows = false
+	return "mysql", config.FormatDSN(), nil
+}
@@ -0,0 +1,45 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/db/storertest"
+	"github.com/aultimus/slack-user-data-service/server"
+	"github.com/jmoiron/sqlx"
+)
+
+// TestMySQL runs the conformance suite against the database given by
+// TEST_MYSQL_CONNECTION_STRING (mysql://<dsn>), the users tables are wiped
+// between tests
+func TestMySQL(t *testing.T) {
+	connStr := os.Getenv("TEST_MYSQL_CONNECTION_STRING")
+	if connStr == "" {
+		t.Skip("TEST_MYSQL_CONNECTION_STRING not set")
+	}
+	driverName, dsn, err := db.ParseConnectionString(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbConn, err := sqlx.Connect(driverName, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbConn.Close()
+	migrator, err := db.NewMigrator(dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	storertest.RunStorerTests(t, func(t *testing.T) server.Storer {
+		_, err := dbConn.Exec("TRUNCATE users; TRUNCATE user_history; TRUNCATE processed_events; TRUNCATE events_inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db.NewMySQL(dbConn)
+	})
+}
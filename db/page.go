@@ -0,0 +1,110 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	// DefaultPageSize is used when a caller does not request a page size
+	DefaultPageSize = 100
+	// MaxPageSize bounds how many users are loaded into memory per request
+	MaxPageSize = 1000
+)
+
+// ErrInvalidCursor is returned when a cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	cursorAfter  = "a:"
+	cursorBefore = "b:"
+)
+
+// Cursor marks a position in the users table ordered by id. Pages are
+// fetched using keyset pagination so a cursor stays valid as users are added
+// or removed, callers should treat its encoded form as opaque
+type Cursor struct {
+	// ID is the id of the user at the edge of the previous page
+	ID string
+	// Before is true when paging backwards from ID
+	Before bool
+}
+
+// Encode returns the opaque string representation of the cursor
+func (c Cursor) Encode() string {
+	prefix := cursorAfter
+	if c.Before {
+		prefix = cursorBefore
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(prefix + c.ID))
+}
+
+// DecodeCursor parses a cursor previously returned by Encode, the empty string
+// decodes to a cursor pointing at the first page
+func DecodeCursor(s string) (Cursor, error) {
+	if s == "" {
+		return Cursor{}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	raw := string(b)
+	switch {
+	case strings.HasPrefix(raw, cursorAfter):
+		return Cursor{ID: strings.TrimPrefix(raw, cursorAfter)}, nil
+	case strings.HasPrefix(raw, cursorBefore):
+		return Cursor{ID: strings.TrimPrefix(raw, cursorBefore), Before: true}, nil
+	}
+	return Cursor{}, ErrInvalidCursor
+}
+
+// ClampPageSize returns a page size within (0, MaxPageSize]
+func ClampPageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
+
+// Page is a single page of users ordered by id along with cursors for the
+// adjacent pages, a cursor is empty if there is no such page
+type Page struct {
+	Users      []User
+	NextCursor string
+	PrevCursor string
+}
+
+// NewPage builds a page from rows fetched in the direction of the cursor.
+// Storers should fetch limit+1 rows, the extra row signals that there are
+// further results in that direction and is not returned
+func NewPage(rows []User, c Cursor, limit int) Page {
+	more := len(rows) > limit
+	if more {
+		rows = rows[:limit]
+	}
+	hasNext, hasPrev := more, c.ID != ""
+	if c.Before {
+		// rows were fetched in descending order
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+		hasNext, hasPrev = true, more
+	}
+
+	page := Page{Users: rows}
+	if len(rows) == 0 {
+		return page
+	}
+	if hasNext {
+		page.NextCursor = Cursor{ID: rows[len(rows)-1].ID}.Encode()
+	}
+	if hasPrev {
+		page.PrevCursor = Cursor{ID: rows[0].ID, Before: true}.Encode()
+	}
+	return page
+}
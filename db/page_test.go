@@ -0,0 +1,72 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	a := assert.New(t)
+	for _, c := range []Cursor{{}, {ID: "U1"}, {ID: "U1", Before: true}, {ID: "a:b"}} {
+		decoded, err := DecodeCursor(c.Encode())
+		a.NoError(err)
+		a.Equal(c, decoded)
+	}
+
+	c, err := DecodeCursor("")
+	a.NoError(err)
+	a.Equal(Cursor{}, c)
+
+	_, err = DecodeCursor("not base64!")
+	a.Equal(ErrInvalidCursor, err)
+	_, err = DecodeCursor(Cursor{ID: "U1"}.Encode()[2:])
+	a.Equal(ErrInvalidCursor, err)
+}
+
+func TestClampPageSize(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(DefaultPageSize, ClampPageSize(0))
+	a.Equal(DefaultPageSize, ClampPageSize(-1))
+	a.Equal(5, ClampPageSize(5))
+	a.Equal(MaxPageSize, ClampPageSize(MaxPageSize+1))
+}
+
+func TestNewPage(t *testing.T) {
+	a := assert.New(t)
+	users := func(ids ...string) []User {
+		var out []User
+		for _, id := range ids {
+			out = append(out, User{ID: id})
+		}
+		return out
+	}
+
+	// first page with more results
+	page := NewPage(users("U1", "U2", "U3"), Cursor{}, 2)
+	a.Equal(users("U1", "U2"), page.Users)
+	a.Equal(Cursor{ID: "U2"}.Encode(), page.NextCursor)
+	a.Empty(page.PrevCursor)
+
+	// last page reached going forwards
+	page = NewPage(users("U3"), Cursor{ID: "U2"}, 2)
+	a.Equal(users("U3"), page.Users)
+	a.Empty(page.NextCursor)
+	a.Equal(Cursor{ID: "U3", Before: true}.Encode(), page.PrevCursor)
+
+	// going backwards rows arrive in descending order
+	page = NewPage(users("U2", "U1"), Cursor{ID: "U3", Before: true}, 2)
+	a.Equal(users("U1", "U2"), page.Users)
+	a.Equal(Cursor{ID: "U2"}.Encode(), page.NextCursor)
+	a.Empty(page.PrevCursor)
+
+	page = NewPage(users("U4", "U3", "U2"), Cursor{ID: "U5", Before: true}, 2)
+	a.Equal(users("U3", "U4"), page.Users)
+	a.Equal(Cursor{ID: "U3", Before: true}.Encode(), page.PrevCursor)
+
+	// empty table
+	page = NewPage(nil, Cursor{}, 2)
+	a.Empty(page.Users)
+	a.Empty(page.NextCursor)
+	a.Empty(page.PrevCursor)
+}
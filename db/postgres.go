@@ -0,0 +1,17 @@
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+func NewPostgres(dbConn *sqlx.DB) *Postgres {
+	s := newSQLStore(dbConn, " FOR UPDATE", onConflictDoNothingSQL, onConflictUpdateSQL)
+	// lib/pq does not support LastInsertId
+	s.returningID = true
+	return &Postgres{sqlStore: s}
+}
+
+// Postgres implements the Storer interface
+type Postgres struct {
+	sqlStore
+}
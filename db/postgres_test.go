@@ -0,0 +1,42 @@
+package db_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/db/storertest"
+	"github.com/aultimus/slack-user-data-service/server"
+	"github.com/jmoiron/sqlx"
+
+	_ "github.com/lib/pq"
+)
+
+// TestPostgres runs the conformance suite against the database given by
+// TEST_DB_CONNECTION_STRING, the users tables are wiped between tests
+func TestPostgres(t *testing.T) {
+	dbStr := os.Getenv("TEST_DB_CONNECTION_STRING")
+	if dbStr == "" {
+		t.Skip("TEST_DB_CONNECTION_STRING not set")
+	}
+	dbConn, err := sqlx.Connect("postgres", dbStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbConn.Close()
+	migrator, err := db.NewMigrator(dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	storertest.RunStorerTests(t, func(t *testing.T) server.Storer {
+		_, err := dbConn.Exec("TRUNCATE users, user_history, processed_events, events_inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db.NewPostgres(dbConn)
+	})
+}
@@ -0,0 +1,462 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sqlStore implements the Storer interface for sql databases, queries are
+// written with ? placeholders and rebound for the connected database
+type sqlStore struct {
+	dbConn *sqlx.DB
+	// forUpdate is appended to selects of rows which are about to be written
+	// to lock them, it is empty for databases which serialise writers anyway
+	forUpdate string
+	// insertConflictSQL ends an insert into a table with an id primary key so
+	// that rows which already exist are left untouched and not counted as
+	// affected rows
+	insertConflictSQL string
+	// upsertConflictSQL ends an insert of users so that users which already
+	// exist have every column but id overwritten
+	upsertConflictSQL string
+	// txOptions are used for write transactions, nil uses the default
+	txOptions *sql.TxOptions
+	// returningID is true for databases which return generated ids with a
+	// RETURNING clause rather than through LastInsertId
+	returningID bool
+}
+
+func newSQLStore(dbConn *sqlx.DB, forUpdate, insertConflictSQL, upsertConflictSQL string) sqlStore {
+	return sqlStore{
+		dbConn:            dbConn,
+		forUpdate:         forUpdate,
+		insertConflictSQL: insertConflictSQL,
+		upsertConflictSQL: upsertConflictSQL,
+	}
+}
+
+// sqliteBusyTimeout is how many milliseconds sqlite waits for the database to
+// be unlocked before failing a query
+const sqliteBusyTimeout = "5000"
+
+// ParseConnectionString returns the database driver name and driver specific
+// data source name for a connection string. sqlite databases are given as
+// sqlite://<path> and mysql databases as mysql://<dsn>, anything else is
+// assumed to be a postgres connection string
+func ParseConnectionString(connStr string) (string, string, error) {
+	if strings.HasPrefix(connStr, "mysql://") {
+		return parseMySQLConnectionString(strings.TrimPrefix(connStr, "mysql://"))
+	}
+	if !strings.HasPrefix(connStr, "sqlite://") {
+		return "postgres", connStr, nil
+	}
+	u, err := url.Parse(connStr)
+	if err != nil {
+		return "", "", err
+	}
+	path := u.Host + u.Path
+	if path == "" {
+		return "", "", errors.New("sqlite connection string has no path")
+	}
+	query := u.Query()
+	if query.Get("_busy_timeout") == "" {
+		query.Set("_busy_timeout", sqliteBusyTimeout)
+	}
+	return "sqlite3", "file:" + path + "?" + query.Encode(), nil
+}
+
+// storedUser is a user along with the event_time of the webhook which last
+// wrote it, which is not part of the user's data
+type storedUser struct {
+	User
+	EventTime int64 `db:"event_time"`
+}
+
+// storedColumns lists the columns of the users table in the order values are
+// returned by storedUser.values
+const storedColumns = userColumns + ", event_time"
+
+func (u storedUser) values() []interface{} {
+	return append(u.User.values(), u.EventTime)
+}
+
+// storedPlaceholders is a placeholder for every column in storedColumns
+var storedPlaceholders = strings.TrimSuffix(
+	strings.Repeat("?,", len(strings.Split(storedColumns, ","))), ",")
+
+// assignUserColumns formats an assignment to every column in storedColumns
+// but id, format is given the column name as its only argument
+func assignUserColumns(format string) string {
+	var assignments []string
+	for _, col := range strings.Split(storedColumns, ",") {
+		col = strings.TrimSpace(col)
+		if col != "id" {
+			assignments = append(assignments, fmt.Sprintf(format, col))
+		}
+	}
+	return strings.Join(assignments, ", ")
+}
+
+// the ON CONFLICT clauses are shared by postgres and sqlite
+var (
+	onConflictDoNothingSQL = "ON CONFLICT (id) DO NOTHING"
+	onConflictUpdateSQL    = "ON CONFLICT (id) DO UPDATE SET " + assignUserColumns("%[1]s=EXCLUDED.%[1]s")
+)
+
+// insertUsersSQL returns an insert of n users ending with conflictSQL
+func insertUsersSQL(n int, conflictSQL string) string {
+	rows := strings.TrimSuffix(strings.Repeat("("+storedPlaceholders+"),", n), ",")
+	return "INSERT INTO users (" + storedColumns + ") VALUES " + rows + " " + conflictSQL
+}
+
+// usersValues returns the values of every user in the order of insertUsersSQL
+func usersValues(users []storedUser) []interface{} {
+	values := make([]interface{}, 0, len(users)*len(strings.Split(storedColumns, ",")))
+	for _, user := range users {
+		values = append(values, user.values()...)
+	}
+	return values
+}
+
+// upsertBatchSize is the most users written by a statement or transaction, it
+// keeps statements within the databases' limits on bound parameters
+const upsertBatchSize = 500
+
+// maxConcurrentCreateRetries is how many times a batch is retried after
+// another writer created one of its users
+const maxConcurrentCreateRetries = 3
+
+// ErrConcurrentCreate is returned when another writer created a user while a
+// batch was being written. The batch is rolled back and retried, and this is
+// returned wrapped once the retries run out
+var ErrConcurrentCreate = errors.New("user created concurrently")
+
+// CreateUsers upserts users, recording a row in user history for every user
+// which is created or whose data changes. Users are written in batches, each
+// in its own transaction, so an error may leave earlier batches written. If a
+// user appears more than once only its last entry is written. Users older
+// than those stored are skipped. It returns how many users were created or
+// changed
+func (s *sqlStore) CreateUsers(users []User, origin Origin) (int, error) {
+	defer s.observe("create_users", time.Now())
+	written, _, err := s.createUsers(users, origin)
+	return written, err
+}
+
+// createUsers implements CreateUsers and also returns how many users were
+// skipped for being stale
+func (s *sqlStore) createUsers(users []User, origin Origin) (int, int, error) {
+	users = lastByID(users)
+	var written, stale int
+	for start := 0; start < len(users); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		w, st, err := s.upsertBatch(users[start:end], origin)
+		for retry := 0; errors.Is(err, ErrConcurrentCreate) && retry < maxConcurrentCreateRetries; retry++ {
+			w, st, err = s.upsertBatch(users[start:end], origin)
+		}
+		if errors.Is(err, ErrConcurrentCreate) {
+			err = fmt.Errorf("gave up writing users after %d retries: %w", maxConcurrentCreateRetries, err)
+		}
+		if err != nil {
+			return written, stale, err
+		}
+		written += w
+		stale += st
+	}
+	return written, stale, nil
+}
+
+// lastByID returns users without duplicate ids, keeping the last entry for
+// each id in the position of the first
+func lastByID(users []User) []User {
+	index := make(map[string]int, len(users))
+	deduped := make([]User, 0, len(users))
+	for _, user := range users {
+		if i, ok := index[user.ID]; ok {
+			deduped[i] = user
+			continue
+		}
+		index[user.ID] = len(deduped)
+		deduped = append(deduped, user)
+	}
+	return deduped
+}
+
+// upsertBatch writes users with a statement each for locking the existing
+// users, inserting new users, updating changed users and recording history.
+// Users are compared with their locked rows so stale and unchanged users are
+// not written, it returns how many users were written and how many were stale
+func (s *sqlStore) upsertBatch(users []User, origin Origin) (int, int, error) {
+	tx, err := s.dbConn.BeginTxx(context.Background(), s.txOptions)
+	if err != nil {
+		return 0, 0, err
+	}
+	// lock the existing rows so concurrent writers record consistent history
+	existing, err := s.lockUsers(tx, users)
+	if err != nil {
+		return 0, 0, rollback(tx, err)
+	}
+
+	var inserts, updates []storedUser
+	var history []interface{}
+	var stale int
+	for _, user := range users {
+		old, ok := existing[user.ID]
+		if ok && isStale(old.User, old.EventTime, user, origin) {
+			stale++
+			continue
+		}
+		if ok && old.Equal(user) {
+			continue // nothing changed so there is nothing to write
+		}
+		write := storedUser{User: user, EventTime: origin.EventTime}
+		var before *User
+		if ok {
+			before = &old.User
+			if old.EventTime > write.EventTime {
+				write.EventTime = old.EventTime
+			}
+			updates = append(updates, write)
+		} else {
+			inserts = append(inserts, write)
+		}
+		oldValue, newValue, err := historyValues(before, user)
+		if err != nil {
+			return 0, 0, rollback(tx, err)
+		}
+		history = append(history, user.ID, origin.Source, origin.EventID, oldValue, newValue)
+	}
+
+	if len(inserts) > 0 {
+		res, err := tx.Exec(tx.Rebind(insertUsersSQL(len(inserts), s.insertConflictSQL)),
+			usersValues(inserts)...)
+		if err != nil {
+			return 0, 0, rollback(tx, err)
+		}
+		created, err := res.RowsAffected()
+		if err != nil {
+			return 0, 0, rollback(tx, err)
+		}
+		// there were no rows to lock for new users so a concurrent writer may
+		// have created some, retrying locks their rows and updates them instead
+		if created != int64(len(inserts)) {
+			return 0, 0, rollback(tx, ErrConcurrentCreate)
+		}
+	}
+	if len(updates) > 0 {
+		_, err = tx.Exec(tx.Rebind(insertUsersSQL(len(updates), s.upsertConflictSQL)),
+			usersValues(updates)...)
+		if err != nil {
+			return 0, 0, rollback(tx, err)
+		}
+	}
+	changed := len(inserts) + len(updates)
+	if changed > 0 {
+		rows := strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?),", changed), ",")
+		_, err = tx.Exec(tx.Rebind(`INSERT INTO user_history (user_id, source, event_id,
+			old_value, new_value) VALUES `+rows), history...)
+		if err != nil {
+			return 0, 0, rollback(tx, err)
+		}
+	}
+	return changed, stale, tx.Commit()
+}
+
+// lockUsers selects and locks the stored users with the same ids as users,
+// rows are locked in id order so concurrent batches cannot deadlock
+func (s *sqlStore) lockUsers(tx *sqlx.Tx, users []User) (map[string]storedUser, error) {
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	query, args, err := sqlx.In("SELECT "+storedColumns+" FROM users WHERE id IN (?) ORDER BY id"+s.forUpdate, ids)
+	if err != nil {
+		return nil, err
+	}
+	var rows []storedUser
+	if err = tx.Select(&rows, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	existing := make(map[string]storedUser, len(rows))
+	for _, row := range rows {
+		existing[row.ID] = row
+	}
+	return existing, nil
+}
+
+// ClaimEvent records that a webhook event has been processed until expires,
+// it reports false if the event already had been. Expired claims are
+// deleted first so the table only holds recent events
+func (s *sqlStore) ClaimEvent(eventID string, expires time.Time) (bool, error) {
+	defer s.observe("claim_event", time.Now())
+	_, err := s.dbConn.Exec(s.dbConn.Rebind("DELETE FROM processed_events WHERE expires_at <= ?"),
+		time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	res, err := s.dbConn.Exec(s.dbConn.Rebind("INSERT INTO processed_events (id, expires_at) VALUES (?, ?) "+
+		s.insertConflictSQL), eventID, expires.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	claimed, err := res.RowsAffected()
+	return claimed == 1, err
+}
+
+// SaveEvent saves a raw webhook payload to the inbox and returns its id
+func (s *sqlStore) SaveEvent(eventID string, payload []byte) (int64, error) {
+	defer s.observe("save_event", time.Now())
+	query := s.dbConn.Rebind(`INSERT INTO events_inbox (event_id, payload, received_at)
+		VALUES (?, ?, ?)`)
+	args := []interface{}{eventID, string(payload), time.Now().UnixMilli()}
+	if s.returningID {
+		var id int64
+		err := s.dbConn.Get(&id, query+" RETURNING id", args...)
+		return id, err
+	}
+	res, err := s.dbConn.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// CompleteEvent marks an inbox event as processed
+func (s *sqlStore) CompleteEvent(id int64) error {
+	defer s.observe("complete_event", time.Now())
+	_, err := s.dbConn.Exec(s.dbConn.Rebind("UPDATE events_inbox SET processed_at=? WHERE id=?"),
+		time.Now().UnixMilli(), id)
+	return err
+}
+
+// PendingEvents returns the inbox events which have not been processed,
+// oldest first
+func (s *sqlStore) PendingEvents() ([]InboxEvent, error) {
+	defer s.observe("pending_events", time.Now())
+	var rows []inboxRow
+	err := s.dbConn.Select(&rows, `SELECT id, event_id, payload, received_at FROM events_inbox
+		WHERE processed_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]InboxEvent, len(rows))
+	for i, row := range rows {
+		events[i] = row.toEvent()
+	}
+	return events, nil
+}
+
+// PruneEvents deletes inbox events which were processed before the given
+// time and returns how many were deleted
+func (s *sqlStore) PruneEvents(before time.Time) (int, error) {
+	defer s.observe("prune_events", time.Now())
+	res, err := s.dbConn.Exec(s.dbConn.Rebind("DELETE FROM events_inbox WHERE processed_at < ?"),
+		before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	return int(pruned), err
+}
+
+// UpdateUser upserts a user and reports whether it was created or changed, it
+// returns ErrStaleUser if the stored user is newer
+func (s *sqlStore) UpdateUser(user User, origin Origin) (bool, error) {
+	defer s.observe("update_user", time.Now())
+	written, stale, err := s.createUsers([]User{user}, origin)
+	if err == nil && stale > 0 {
+		err = ErrStaleUser
+	}
+	return written > 0, err
+}
+
+// CountUsers returns how many users are stored and how many of those are
+// deleted
+func (s *sqlStore) CountUsers() (int, int, error) {
+	defer s.observe("count_users", time.Now())
+	var counts struct {
+		Total   int `db:"total"`
+		Deleted int `db:"deleted"`
+	}
+	err := s.dbConn.Get(&counts, `SELECT COUNT(*) AS total,
+		COALESCE(SUM(CASE WHEN deleted THEN 1 ELSE 0 END), 0) AS deleted FROM users`)
+	return counts.Total, counts.Deleted, err
+}
+
+// Ping checks that the database is reachable
+func (s *sqlStore) Ping(ctx context.Context) error {
+	defer s.observe("ping", time.Now())
+	return s.dbConn.PingContext(ctx)
+}
+
+// GetUserHistory returns the recorded changes to a user, most recent first,
+// or ErrUserNotFound if the user has never been stored
+func (s *sqlStore) GetUserHistory(id string) ([]UserChange, error) {
+	defer s.observe("get_user_history", time.Now())
+	var rows []userChangeRow
+	err := s.dbConn.Select(&rows, s.dbConn.Rebind(`SELECT id, user_id, source, event_id,
+		old_value, new_value, changed_at FROM user_history WHERE user_id=? ORDER BY id DESC`), id)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		// users written before history was recorded have no history
+		_, err = s.GetUser(id)
+		return []UserChange{}, err
+	}
+
+	changes := make([]UserChange, len(rows))
+	for i, row := range rows {
+		changes[i], err = row.toChange()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// GetUsersPage returns up to limit users ordered by id starting from the
+// position given by an encoded cursor, an empty cursor fetches the first page
+func (s *sqlStore) GetUsersPage(cursor string, limit int) (Page, error) {
+	defer s.observe("get_users_page", time.Now())
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		return Page{}, err
+	}
+	limit = ClampPageSize(limit)
+
+	var users []User
+	// fetch one extra row to find out whether there is a further page
+	if c.Before {
+		err = s.dbConn.Select(&users, s.dbConn.Rebind(
+			"SELECT "+userColumns+" FROM users WHERE id < ? ORDER BY id DESC LIMIT ?"), c.ID, limit+1)
+	} else {
+		err = s.dbConn.Select(&users, s.dbConn.Rebind(
+			"SELECT "+userColumns+" FROM users WHERE id > ? ORDER BY id LIMIT ?"), c.ID, limit+1)
+	}
+	if err != nil {
+		return Page{}, err
+	}
+	return NewPage(users, c, limit), nil
+}
+
+// GetUser returns the user with the given id or ErrUserNotFound
+func (s *sqlStore) GetUser(id string) (User, error) {
+	defer s.observe("get_user", time.Now())
+	var user User
+	err := s.dbConn.Get(&user, s.dbConn.Rebind("SELECT "+userColumns+" FROM users WHERE id=?"), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
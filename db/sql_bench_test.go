@@ -0,0 +1,147 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// createUsersPerUser is CreateUsers as it was before users were written in
+// batches, with a lock, upsert and history insert per user. It is kept to
+// benchmark against
+func (s *sqlStore) createUsersPerUser(users []User, origin Origin) error {
+	tx, err := s.dbConn.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err = s.upsertUser(tx, user, origin); err != nil {
+			return rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) upsertUser(tx *sqlx.Tx, user User, origin Origin) error {
+	var old *User
+	for {
+		var existing User
+		err := tx.Get(&existing, tx.Rebind("SELECT "+userColumns+" FROM users WHERE id=?"+s.forUpdate), user.ID)
+		if err == nil {
+			old = &existing
+			_, err = tx.Exec(tx.Rebind(insertUsersSQL(1, s.upsertConflictSQL)),
+				storedUser{User: user}.values()...)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		res, err := tx.Exec(tx.Rebind(insertUsersSQL(1, s.insertConflictSQL)),
+			storedUser{User: user}.values()...)
+		if err != nil {
+			return err
+		}
+		if created, err := res.RowsAffected(); err != nil {
+			return err
+		} else if created == 1 {
+			break
+		}
+	}
+	if old != nil && old.Equal(user) {
+		return nil
+	}
+	oldValue, newValue, err := historyValues(old, user)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind(`INSERT INTO user_history (user_id, source, event_id, old_value, new_value)
+		VALUES (?, ?, ?, ?, ?)`),
+		user.ID, origin.Source, origin.EventID, oldValue, newValue)
+	return err
+}
+
+// BenchmarkCreateUsers compares batched and per user writes of an initial
+// sync into an empty database. sqlite is always benchmarked, postgres is too
+// if TEST_DB_CONNECTION_STRING is set
+func BenchmarkCreateUsers(b *testing.B) {
+	stores := map[string]*sqlStore{"sqlite": benchmarkSQLite(b)}
+	if dbStr := os.Getenv("TEST_DB_CONNECTION_STRING"); dbStr != "" {
+		stores["postgres"] = &NewPostgres(benchmarkDB(b, "postgres", dbStr)).sqlStore
+	}
+
+	origin := Origin{Source: SourceInitialSync}
+	for name, s := range stores {
+		for _, n := range []int{1000, 10000} {
+			users := make([]User, n)
+			for i := range users {
+				users[i] = User{ID: fmt.Sprintf("U%08d", i), Name: fmt.Sprintf("user %d", i),
+					RealName: "Some User", TZ: "Europe/London", Updated: 1650000000,
+					ProfileFields: ProfileFields{"Xf01": {Value: "climbing", Label: "hobby"}}}
+			}
+			s := s
+			b.Run(fmt.Sprintf("%s/batched/%d", name, n), func(b *testing.B) {
+				benchmarkWrite(b, s, func() error {
+					_, err := s.CreateUsers(users, origin)
+					return err
+				})
+			})
+			b.Run(fmt.Sprintf("%s/per_user/%d", name, n), func(b *testing.B) {
+				benchmarkWrite(b, s, func() error { return s.createUsersPerUser(users, origin) })
+			})
+		}
+	}
+}
+
+// benchmarkWrite times write against an emptied database
+func benchmarkWrite(b *testing.B, s *sqlStore, write func() error) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if _, err := s.dbConn.Exec("DELETE FROM users"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := s.dbConn.Exec("DELETE FROM user_history"); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := write(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkSQLite(b *testing.B) *sqlStore {
+	driverName, dsn, err := ParseConnectionString("sqlite://" + filepath.Join(b.TempDir(), "users.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &NewSQLite(benchmarkDB(b, driverName, dsn)).sqlStore
+}
+
+// benchmarkDB connects to and migrates a database, it is closed once the
+// benchmark completes
+func benchmarkDB(b *testing.B, driverName, dsn string) *sqlx.DB {
+	dbConn, err := sqlx.Connect(driverName, dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { dbConn.Close() })
+	migrator, err := NewMigrator(dbConn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		b.Fatal(err)
+	}
+	return dbConn
+}
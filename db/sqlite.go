@@ -0,0 +1,21 @@
+package db
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// NewSQLite returns a SQLite store, it limits dbConn to a single connection
+// as sqlite only allows one writer at a time and in memory databases are
+// per connection
+func NewSQLite(dbConn *sqlx.DB) *SQLite {
+	dbConn.SetMaxOpenConns(1)
+	// sqlite has no row locks, a write transaction locks the whole database
+	return &SQLite{sqlStore: newSQLStore(dbConn, "",
+		onConflictDoNothingSQL, onConflictUpdateSQL)}
+}
+
+// SQLite implements the Storer interface for small deployments which do not
+// want to run a database server
+type SQLite struct {
+	sqlStore
+}
@@ -0,0 +1,73 @@
+package db_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/db/storertest"
+	"github.com/aultimus/slack-user-data-service/server"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openSQLite returns a migrated database in a temporary directory
+func openSQLite(t *testing.T) *sqlx.DB {
+	driverName, dsn, err := db.ParseConnectionString(
+		"sqlite://" + filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbConn, err := sqlx.Connect(driverName, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	migrator, err := db.NewMigrator(dbConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return dbConn
+}
+
+func TestSQLite(t *testing.T) {
+	storertest.RunStorerTests(t, func(t *testing.T) server.Storer {
+		return db.NewSQLite(openSQLite(t))
+	})
+}
+
+func TestSQLiteMigrateDown(t *testing.T) {
+	a := assert.New(t)
+	migrator, err := db.NewMigrator(openSQLite(t))
+	a.NoError(err)
+
+	statuses, err := migrator.Status()
+	a.NoError(err)
+	reverted, err := migrator.Down(len(statuses))
+	a.NoError(err)
+	a.Equal(len(statuses), reverted)
+	applied, err := migrator.Up()
+	a.NoError(err)
+	a.Equal(len(statuses), applied)
+}
+
+// TestSQLiteConcurrentCreateRetries makes every insert look as if another
+// writer created the users first, CreateUsers must give up rather than retry
+// forever
+func TestSQLiteConcurrentCreateRetries(t *testing.T) {
+	a := assert.New(t)
+	dbConn := openSQLite(t)
+	_, err := dbConn.Exec(`CREATE TRIGGER ignore_user_inserts BEFORE INSERT ON users
+		BEGIN SELECT RAISE(IGNORE); END`)
+	a.NoError(err)
+
+	_, err = db.NewSQLite(dbConn).CreateUsers([]db.User{{ID: "U1", Name: "foo"}},
+		db.Origin{Source: db.SourceInitialSync})
+	a.True(errors.Is(err, db.ErrConcurrentCreate), "unexpected error: %v", err)
+}
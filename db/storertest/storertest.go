@@ -0,0 +1,479 @@
+// Package storertest provides a conformance test suite which every
+// implementation of server.Storer must pass
+package storertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/server"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// RunStorerTests runs the conformance suite, newStorer must return an empty
+// Storer each time it is called
+func RunStorerTests(t *testing.T, newStorer func(t *testing.T) server.Storer) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s server.Storer)
+	}{
+		{"GetUserNotFound", testGetUserNotFound},
+		{"CreateUsers", testCreateUsers},
+		{"CreateManyUsers", testCreateManyUsers},
+		{"Upsert", testUpsert},
+		{"UnchangedWrites", testUnchangedWrites},
+		{"StaleWrites", testStaleWrites},
+		{"Pagination", testPagination},
+		{"InvalidCursor", testInvalidCursor},
+		{"History", testHistory},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"ConcurrentCreates", testConcurrentCreates},
+		{"ClaimEvent", testClaimEvent},
+		{"Inbox", testInbox},
+		{"CountUsers", testCountUsers},
+		{"Ping", testPing},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStorer(t))
+		})
+	}
+}
+
+var (
+	initialSync = db.Origin{Source: db.SourceInitialSync}
+	webhook     = db.Origin{Source: db.SourceWebhook, EventID: "Ev01"}
+)
+
+// create writes users and returns how many the Storer reports were written
+func create(t *testing.T, s server.Storer, origin db.Origin, users []db.User) int {
+	written, err := s.CreateUsers(users, origin)
+	assert.NoError(t, err)
+	return written
+}
+
+// update writes a user and returns whether the Storer reports it was written
+func update(t *testing.T, s server.Storer, origin db.Origin, user db.User) bool {
+	changed, err := s.UpdateUser(user, origin)
+	assert.NoError(t, err)
+	return changed
+}
+
+func randomUser(id string) db.User {
+	return server.APIToDBUser(util.GenerateRandomUser(id))
+}
+
+func testGetUserNotFound(t *testing.T, s server.Storer) {
+	_, err := s.GetUser("U404")
+	assert.Equal(t, db.ErrUserNotFound, err)
+	_, err = s.GetUserHistory("U404")
+	assert.Equal(t, db.ErrUserNotFound, err)
+}
+
+func testCreateUsers(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	a.Zero(create(t, s, initialSync, nil))
+
+	users := []db.User{randomUser("U1"), randomUser("U2"), {ID: "U3"}}
+	a.Equal(3, create(t, s, initialSync, users))
+	for _, u := range users {
+		stored, err := s.GetUser(u.ID)
+		a.NoError(err)
+		a.Equal(u, stored)
+	}
+
+	// stored users are not aliased by the caller's data
+	users[0].ProfileFields["Xf0000001"] = db.ProfileField{Value: "mutated"}
+	stored, err := s.GetUser("U1")
+	a.NoError(err)
+	a.NotEqual("mutated", stored.ProfileFields["Xf0000001"].Value)
+}
+
+func testCreateManyUsers(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	// enough users to be written in several batches by the sql stores
+	var users []db.User
+	for i := 0; i < 1234; i++ {
+		users = append(users, db.User{ID: fmt.Sprintf("U%04d", i), Name: "before"})
+	}
+	create(t, s, initialSync, users)
+
+	// rewrite half of them, along with a duplicate whose last entry wins
+	var updates []db.User
+	for i := 0; i < len(users); i += 2 {
+		updates = append(updates, db.User{ID: users[i].ID, Name: "after"})
+	}
+	updates = append([]db.User{{ID: "U0001", Name: "overwritten"}}, updates...)
+	updates = append(updates, db.User{ID: "U0001", Name: "after"})
+	a.Equal(len(users)/2+1, create(t, s, webhook, updates))
+
+	page, err := s.GetUsersPage("", db.MaxPageSize)
+	a.NoError(err)
+	next, err := s.GetUsersPage(page.NextCursor, db.MaxPageSize)
+	a.NoError(err)
+	stored := append(page.Users, next.Users...)
+	if !a.Len(stored, len(users)) {
+		return
+	}
+	for i, u := range stored {
+		a.Equal(users[i].ID, u.ID)
+		if i%2 == 0 || i == 1 {
+			a.Equal("after", u.Name, u.ID)
+		} else {
+			a.Equal("before", u.Name, u.ID)
+		}
+	}
+
+	history, err := s.GetUserHistory("U1232")
+	a.NoError(err)
+	a.Len(history, 2)
+	history, err = s.GetUserHistory("U1233")
+	a.NoError(err)
+	a.Len(history, 1)
+}
+
+func testUpsert(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	user := randomUser("U1")
+	create(t, s, initialSync, []db.User{user})
+
+	// every column is overwritten
+	updated := randomUser("U1")
+	updated.Deleted = !user.Deleted
+	updated.ProfileFields = nil
+	a.True(update(t, s, webhook, updated))
+	stored, err := s.GetUser("U1")
+	a.NoError(err)
+	a.Equal(updated, stored)
+
+	// UpdateUser creates unknown users
+	created := randomUser("U2")
+	a.True(update(t, s, webhook, created))
+	stored, err = s.GetUser("U2")
+	a.NoError(err)
+	a.Equal(created, stored)
+}
+
+func testUnchangedWrites(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	user := randomUser("U1")
+	other := randomUser("U2")
+	a.Equal(2, create(t, s, initialSync, []db.User{user, other}))
+
+	// identical data is reported as unchanged and records no history
+	a.False(update(t, s, webhook, user))
+	changed := other
+	changed.Deleted = !other.Deleted
+	a.Equal(1, create(t, s, webhook, []db.User{user, changed}))
+
+	// empty custom fields are the same as none
+	noFields := db.User{ID: "U3"}
+	a.True(update(t, s, webhook, noFields))
+	noFields.ProfileFields = db.ProfileFields{}
+	a.False(update(t, s, webhook, noFields))
+
+	history, err := s.GetUserHistory("U1")
+	a.NoError(err)
+	a.Len(history, 1)
+	history, err = s.GetUserHistory("U2")
+	a.NoError(err)
+	a.Len(history, 2)
+}
+
+func testStaleWrites(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	user := db.User{ID: "U1", Name: "first", Updated: 100}
+	create(t, s, initialSync, []db.User{user})
+	event := func(eventTime int64) db.Origin {
+		return db.Origin{Source: db.SourceWebhook, EventID: "Ev01", EventTime: eventTime}
+	}
+
+	// an older revision is rejected
+	older := db.User{ID: "U1", Name: "older", Updated: 90}
+	changed, err := s.UpdateUser(older, event(1000))
+	a.Equal(db.ErrStaleUser, err)
+	a.False(changed)
+
+	second := db.User{ID: "U1", Name: "second", Updated: 100}
+	a.True(update(t, s, event(1000), second))
+	// an earlier event for the same revision, e.g. a delayed retry, is rejected
+	_, err = s.UpdateUser(db.User{ID: "U1", Name: "earlier", Updated: 100}, event(999))
+	a.Equal(db.ErrStaleUser, err)
+	// a newer revision is accepted whatever its event time
+	third := db.User{ID: "U1", Name: "third", Updated: 200}
+	a.True(update(t, s, event(500), third))
+
+	// stale users are skipped by CreateUsers without failing the others
+	a.Equal(1, create(t, s, initialSync, []db.User{older, {ID: "U2", Updated: 100}}))
+	stored, err := s.GetUser("U1")
+	a.NoError(err)
+	a.Equal(third, stored)
+
+	// writes not from events only compare updated, so a resync can correct
+	// drift in data whose updated did not change
+	resynced := db.User{ID: "U1", Name: "resynced", Updated: 200}
+	a.True(update(t, s, db.Origin{Source: db.SourceResync}, resynced))
+	stored, err = s.GetUser("U1")
+	a.NoError(err)
+	a.Equal(resynced, stored)
+
+	history, err := s.GetUserHistory("U1")
+	a.NoError(err)
+	a.Len(history, 4)
+}
+
+func testPagination(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	var users []db.User
+	for i := 0; i < 25; i++ {
+		users = append(users, db.User{ID: fmt.Sprintf("U%03d", i)})
+	}
+	create(t, s, initialSync, users)
+
+	ids := func(page db.Page) []string {
+		var out []string
+		for _, u := range page.Users {
+			out = append(out, u.ID)
+		}
+		return out
+	}
+
+	// walk forwards then backwards through every page
+	var pages []db.Page
+	cursor := ""
+	for {
+		page, err := s.GetUsersPage(cursor, 10)
+		a.NoError(err)
+		pages = append(pages, page)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if !a.Len(pages, 3) {
+		return
+	}
+	a.Equal([]string{"U000", "U001", "U002", "U003", "U004", "U005", "U006", "U007", "U008", "U009"}, ids(pages[0]))
+	a.Equal([]string{"U020", "U021", "U022", "U023", "U024"}, ids(pages[2]))
+	a.Empty(pages[0].PrevCursor)
+
+	for i := len(pages) - 1; i > 0; i-- {
+		prev, err := s.GetUsersPage(pages[i].PrevCursor, 10)
+		a.NoError(err)
+		a.Equal(pages[i-1], prev)
+	}
+
+	// users added behind the cursor do not shift the next page
+	update(t, s, webhook, db.User{ID: "U0000"})
+	page, err := s.GetUsersPage(pages[0].NextCursor, 10)
+	a.NoError(err)
+	a.Equal(pages[1], page)
+
+	// the default page size applies when no limit is given
+	for i := 25; i < db.DefaultPageSize+5; i++ {
+		update(t, s, webhook, db.User{ID: fmt.Sprintf("U%03d", i)})
+	}
+	page, err = s.GetUsersPage("", 0)
+	a.NoError(err)
+	a.Len(page.Users, db.DefaultPageSize)
+	a.NotEmpty(page.NextCursor)
+}
+
+func testInvalidCursor(t *testing.T, s server.Storer) {
+	_, err := s.GetUsersPage("not a cursor", 10)
+	assert.Equal(t, db.ErrInvalidCursor, err)
+}
+
+func testHistory(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	user := randomUser("U1")
+	a.Equal(1, create(t, s, initialSync, []db.User{user}))
+	// writing identical data records no history
+	a.Zero(create(t, s, initialSync, []db.User{user}))
+
+	updated := user
+	updated.ProfileStatusText = "a new status"
+	update(t, s, webhook, updated)
+
+	history, err := s.GetUserHistory("U1")
+	a.NoError(err)
+	if !a.Len(history, 2) {
+		return
+	}
+	latest, first := history[0], history[1]
+	a.True(latest.ID > first.ID)
+	a.Equal("U1", latest.UserID)
+	a.Equal(db.SourceWebhook, latest.Source)
+	a.Equal("Ev01", latest.EventID)
+	a.Equal(user, *latest.Old)
+	a.Equal(updated, *latest.New)
+	a.False(latest.ChangedAt.IsZero())
+	a.Equal([]db.FieldChange{{Field: "status_text", Old: user.ProfileStatusText,
+		New: "a new status"}}, latest.Fields())
+
+	a.Equal(db.SourceInitialSync, first.Source)
+	a.Empty(first.EventID)
+	a.Nil(first.Old)
+	a.Equal(user, *first.New)
+
+	// other users have their own history
+	update(t, s, webhook, randomUser("U2"))
+	history, err = s.GetUserHistory("U2")
+	a.NoError(err)
+	a.Len(history, 1)
+}
+
+func testConcurrentUpdates(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	const writers, writes = 5, 10
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				user := db.User{ID: "U1", Name: fmt.Sprintf("writer %d write %d", w, i)}
+				update(t, s, webhook, user)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// every write changed the name so every write is in history, and each
+	// change follows on from the one before it
+	history, err := s.GetUserHistory("U1")
+	a.NoError(err)
+	a.Len(history, writers*writes)
+	sort.Slice(history, func(i, j int) bool { return history[i].ID < history[j].ID })
+	for i := 1; i < len(history); i++ {
+		a.Equal(*history[i-1].New, *history[i].Old)
+	}
+	stored, err := s.GetUser("U1")
+	a.NoError(err)
+	a.Equal(*history[len(history)-1].New, stored)
+}
+
+// testConcurrentCreates races writers creating the same new users, a write may
+// give up with ErrConcurrentCreate but each user must be created exactly once
+func testConcurrentCreates(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	const writers, users = 5, 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			batch := make([]db.User, users)
+			for i := range batch {
+				batch[i] = db.User{ID: fmt.Sprintf("U%02d", i), Name: fmt.Sprintf("writer %d", w)}
+			}
+			_, err := s.CreateUsers(batch, initialSync)
+			if err != nil {
+				a.True(errors.Is(err, db.ErrConcurrentCreate), "unexpected error: %v", err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < users; i++ {
+		id := fmt.Sprintf("U%02d", i)
+		history, err := s.GetUserHistory(id)
+		a.NoError(err)
+		var created int
+		for _, change := range history {
+			if change.Old == nil {
+				created++
+			}
+		}
+		a.Equal(1, created, "user %s", id)
+	}
+}
+
+func testClaimEvent(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	claim := func(eventID string, expires time.Time) bool {
+		claimed, err := s.ClaimEvent(eventID, expires)
+		a.NoError(err)
+		return claimed
+	}
+	later := time.Now().Add(time.Hour)
+
+	a.True(claim("Ev01", later))
+	a.False(claim("Ev01", later))
+	a.True(claim("Ev02", later))
+
+	// expired events can be claimed again
+	a.True(claim("Ev03", time.Now().Add(-time.Second)))
+	a.True(claim("Ev03", later))
+	a.False(claim("Ev03", later))
+}
+
+func testInbox(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	pending, err := s.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+
+	before := time.Now().Add(-time.Second)
+	first, err := s.SaveEvent("Ev01", []byte(`{"type":"event_callback"}`))
+	a.NoError(err)
+	second, err := s.SaveEvent("", []byte(`{}`))
+	a.NoError(err)
+	a.True(second > first)
+
+	pending, err = s.PendingEvents()
+	a.NoError(err)
+	if a.Len(pending, 2) {
+		a.Equal(first, pending[0].ID)
+		a.Equal("Ev01", pending[0].EventID)
+		a.Equal(`{"type":"event_callback"}`, string(pending[0].Payload))
+		a.True(pending[0].ReceivedAt.After(before))
+		a.Equal(second, pending[1].ID)
+	}
+
+	a.NoError(s.CompleteEvent(first))
+	pending, err = s.PendingEvents()
+	a.NoError(err)
+	if a.Len(pending, 1) {
+		a.Equal(second, pending[0].ID)
+	}
+
+	// only processed events are pruned
+	pruned, err := s.PruneEvents(before)
+	a.NoError(err)
+	a.Zero(pruned)
+	pruned, err = s.PruneEvents(time.Now().Add(time.Second))
+	a.NoError(err)
+	a.Equal(1, pruned)
+	pending, err = s.PendingEvents()
+	a.NoError(err)
+	a.Len(pending, 1)
+}
+
+func testCountUsers(t *testing.T, s server.Storer) {
+	a := assert.New(t)
+	total, deleted, err := s.CountUsers()
+	a.NoError(err)
+	a.Zero(total)
+	a.Zero(deleted)
+
+	create(t, s, initialSync, []db.User{{ID: "U1"}, {ID: "U2", Deleted: true}, {ID: "U3"}})
+	total, deleted, err = s.CountUsers()
+	a.NoError(err)
+	a.Equal(3, total)
+	a.Equal(1, deleted)
+}
+
+func testPing(t *testing.T, s server.Storer) {
+	assert.NoError(t, s.Ping(context.Background()))
+}
@@ -10,13 +10,17 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/server"
 	"github.com/aultimus/slack-user-data-service/util"
 	log "github.com/cocoonlife/timber"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/slack-go/slack"
@@ -39,6 +43,18 @@ type UsersResponse struct {
 
 func wipeDatabase(dbConn *sqlx.DB) error {
 	_, err := dbConn.Exec("DELETE FROM users")
+	if err != nil {
+		return err
+	}
+	_, err = dbConn.Exec("DELETE FROM user_history")
+	if err != nil {
+		return err
+	}
+	_, err = dbConn.Exec("DELETE FROM processed_events")
+	if err != nil {
+		return err
+	}
+	_, err = dbConn.Exec("DELETE FROM events_inbox")
 	return err
 }
 
@@ -91,8 +107,21 @@ func parseHTML(data string) ([]slack.User, error) {
 	return out, nil
 }
 
-func fetchUsers(httpClient *http.Client) ([]slack.User, error) {
-	// request html form, parse html form to check results are correct
+// tableUser returns the subset of a user displayed in the first columns of the
+// html table
+func tableUser(in slack.User) slack.User {
+	return slack.User{ID: in.ID, Name: in.Name, Deleted: in.Deleted,
+		RealName: in.RealName, TZ: in.TZ,
+		Profile: slack.UserProfile{
+			StatusText:  in.Profile.StatusText,
+			StatusEmoji: in.Profile.StatusEmoji,
+			Image512:    in.Profile.Image512,
+		},
+	}
+}
+
+// fetchUsersHTML requests the html table and parses it
+func fetchUsersHTML(httpClient *http.Client) ([]slack.User, error) {
 	resp, err := httpClient.Get("http://app:3000/users")
 	if err != nil {
 		return []slack.User{}, err
@@ -100,9 +129,55 @@ func fetchUsers(httpClient *http.Client) ([]slack.User, error) {
 	defer resp.Body.Close()
 
 	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return []slack.User{}, err
+	}
 	return parseHTML(string(b))
 }
 
+// fetchUsers requests every page of users from the json api
+func fetchUsers(httpClient *http.Client) ([]slack.User, error) {
+	var out []slack.User
+	cursor := ""
+	for {
+		resp, err := httpClient.Get("http://app:3000/api/v1/users?limit=250&cursor=" + cursor)
+		if err != nil {
+			return out, err
+		}
+		var usersResp server.UsersResponse
+		err = json.NewDecoder(resp.Body).Decode(&usersResp)
+		resp.Body.Close()
+		if err != nil {
+			return out, err
+		}
+		for _, u := range usersResp.Users {
+			out = append(out, server.DBToAPIUser(u))
+		}
+		if usersResp.NextCursor == "" {
+			return out, nil
+		}
+		cursor = usersResp.NextCursor
+	}
+}
+
+// postEvent sends an event to the webhooks endpoint signed with signingSecret
+func postEvent(httpClient *http.Client, body []byte, signingSecret string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, "http://app:3000/webhooks", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(server.HeaderSlackTimestamp, timestamp)
+	req.Header.Set(server.HeaderSlackSignature,
+		server.ComputeSignature(signingSecret, timestamp, body))
+	return httpClient.Do(req)
+}
+
+func fetchUser(httpClient *http.Client, id string) (*http.Response, error) {
+	return httpClient.Get("http://app:3000/api/v1/users/" + id)
+}
+
 // This is written as one test as multiple go tests are known to run concurrently
 // which can make testing against a single server difficult / unpredictable
 func TestIntegration(t *testing.T) {
@@ -115,10 +190,17 @@ func TestIntegration(t *testing.T) {
 	if token == "" {
 		a.FailNow("SLACK_VERIFICATION_TOKEN must be set")
 	}
+	signingSecret := os.Getenv("SLACK_SIGNING_SECRET")
+	if signingSecret == "" {
+		a.FailNow("SLACK_SIGNING_SECRET must be set")
+	}
 
 	// set up db
-	dbStr := os.Getenv("DB_CONNECTION_STRING")
-	dbConn, err := util.WaitForDB(dbStr)
+	driverName, dbStr, err := db.ParseConnectionString(os.Getenv("DB_CONNECTION_STRING"))
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	dbConn, err := util.WaitForDB(driverName, dbStr, server.DefaultDBConnectAttempts, time.Second)
 	if err != nil {
 		a.FailNow(err.Error())
 	}
@@ -129,6 +211,17 @@ func TestIntegration(t *testing.T) {
 		log.Errorf("failed to connect to db:" + err.Error())
 	}
 
+	// the app migrates on startup too, migrations are safe to run concurrently
+	// and ensure the tables exist before we wipe them
+	migrator, err := db.NewMigrator(dbConn)
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	_, err = migrator.Up()
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+
 	err = wipeDatabase(dbConn)
 	if err != nil {
 		panic(err)
@@ -144,7 +237,7 @@ func TestIntegration(t *testing.T) {
 
 	// run http server to mock slack api
 	router := mux.NewRouter()
-	server := &http.Server{
+	mockSlack := &http.Server{
 		Addr:         ":8081",
 		Handler:      router,
 		ReadTimeout:  10 * time.Second,
@@ -177,9 +270,9 @@ func TestIntegration(t *testing.T) {
 
 	router.HandleFunc("/users.list", usersListHandler)
 
-	go func(server *http.Server) {
-		fmt.Println(server.ListenAndServe().Error())
-	}(server)
+	go func(mockSlack *http.Server) {
+		fmt.Println(mockSlack.ListenAndServe().Error())
+	}(mockSlack)
 
 	// wait until app has hit users.list to intialise users
 	select {
@@ -210,22 +303,48 @@ func TestIntegration(t *testing.T) {
 
 	a.Equal(expected, actual)
 
-	resp, err := httpClient.Get("http://app:3000/users")
+	// the first page of the user facing html table should agree with the json api
+	actualHTML, err := fetchUsersHTML(httpClient)
 	if err != nil {
 		a.FailNow(err.Error())
 	}
-	defer resp.Body.Close()
+	var expectedHTML []slack.User
+	for _, u := range expected[:db.DefaultPageSize] {
+		expectedHTML = append(expectedHTML, tableUser(u))
+	}
+	a.Equal(expectedHTML, actualHTML)
+
+	// single user lookups
+	resp, err := fetchUser(httpClient, expected[0].ID)
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	var user db.User
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	resp.Body.Close()
+	a.NoError(err)
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal(expected[0], server.DBToAPIUser(user))
+
+	resp, err = fetchUser(httpClient, "not-a-user")
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	resp.Body.Close()
+	a.Equal(http.StatusNotFound, resp.StatusCode)
 
 	// send several user_change events, send them to the webhooks endpoint and
 	// check they are reflected on the users page
+	var lastChangedID string
 	for i := 0; i < 25; i++ {
 		userIndex := rand.Intn(len(expected))
+		lastChangedID = expected[userIndex].ID
 		//fmt.Println()
 		//spew.Dump(expected[userIndex])
 		expected[userIndex] = util.GenerateRandomUser(expected[userIndex].ID)
 		//spew.Dump(expected[userIndex])
 		b := util.GenerateUpdateEvent(expected[userIndex], token)
-		resp, err = httpClient.Post("http://app:3000/webhooks", "application/json", bytes.NewBuffer(b))
+		resp, err = postEvent(httpClient, b, signingSecret)
 		a.Equal(200, resp.StatusCode)
 		if err != nil {
 			a.FailNow(err.Error())
@@ -240,10 +359,35 @@ func TestIntegration(t *testing.T) {
 		//spew.Dump(expected[userIndex], actual[userIndex])
 	}
 
+	// the last user changed should have its initial sync and update in history
+	lastChanged := expected[len(expected)-1]
+	for i := range expected {
+		if expected[i].ID == lastChangedID {
+			lastChanged = expected[i]
+		}
+	}
+	resp, err = httpClient.Get("http://app:3000/api/v1/users/" + lastChangedID + "/history")
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	var historyResp server.HistoryResponse
+	err = json.NewDecoder(resp.Body).Decode(&historyResp)
+	resp.Body.Close()
+	a.NoError(err)
+	a.Equal(http.StatusOK, resp.StatusCode)
+	if a.True(len(historyResp.History) >= 2) {
+		latest := historyResp.History[0]
+		a.Equal(db.SourceWebhook, latest.Source)
+		a.Equal(lastChanged, server.DBToAPIUser(*latest.New))
+		oldest := historyResp.History[len(historyResp.History)-1]
+		a.Equal(db.SourceInitialSync, oldest.Source)
+		a.Nil(oldest.Old)
+	}
+
 	// add a new user via user_change event
 	newUser := util.GenerateRandomUser("")
 	b := util.GenerateUpdateEvent(newUser, token)
-	resp, err = httpClient.Post("http://app:3000/webhooks", "application/json", bytes.NewBuffer(b))
+	resp, err = postEvent(httpClient, b, signingSecret)
 	a.Equal(200, resp.StatusCode)
 	if err != nil {
 		a.FailNow(err.Error())
@@ -261,16 +405,69 @@ func TestIntegration(t *testing.T) {
 	}
 	a.Equal(expected, actual)
 
-	// TODO: test that we ignore event types other than 'user_change'
+	// add a new user via team_join event
+	joinedUser := util.GenerateRandomUser("")
+	b = util.GenerateTeamJoinEvent(joinedUser, token)
+	resp, err = postEvent(httpClient, b, signingSecret)
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	a.Equal(200, resp.StatusCode)
+	time.Sleep(time.Millisecond * 200)
+
+	expected = append(expected, joinedUser)
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i].ID < expected[j].ID
+	})
+
+	actual, err = fetchUsers(httpClient)
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	a.Equal(expected, actual)
+
+	// TODO: test that we ignore event types other than 'user_change' and 'team_join'
+
+	// respond to the handshake slack performs when the request url is configured
+	challenge := uuid.NewString()
+	b = util.GenerateURLVerificationEvent(challenge, token)
+	resp, err = postEvent(httpClient, b, signingSecret)
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	a.NoError(err)
+	a.Equal(http.StatusOK, resp.StatusCode)
+	a.Equal(challenge, string(body))
 
-	// send event without verification token and check it is not processed
+	// send an event signed with the wrong secret and check it is rejected
 	anotherUser := util.GenerateRandomUser("")
+	b = util.GenerateUpdateEvent(anotherUser, token)
+	resp, err = postEvent(httpClient, b, "foo")
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	a.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// send an unsigned event without verification token and check it is rejected
 	b = util.GenerateUpdateEvent(anotherUser, "foo")
 	resp, err = httpClient.Post("http://app:3000/webhooks", "application/json", bytes.NewBuffer(b))
-	a.Equal(200, resp.StatusCode)
 	if err != nil {
 		a.FailNow(err.Error())
 	}
+	a.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// send a signed but malformed event and check it is rejected
+	resp, err = postEvent(httpClient, []byte("not json"), signingSecret)
+	if err != nil {
+		a.FailNow(err.Error())
+	}
+	a.Equal(http.StatusBadRequest, resp.StatusCode)
+	var errResp server.ErrorResponse
+	a.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	resp.Body.Close()
+	a.Equal(http.StatusBadRequest, errResp.Status)
 	time.Sleep(time.Millisecond * 200)
 
 	actual, err = fetchUsers(httpClient)
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	log "github.com/cocoonlife/timber"
+	"github.com/gorilla/mux"
+)
+
+// ErrorResponse is the json body returned alongside non 2xx api responses
+type ErrorResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// UsersResponse is the json body returned by the users listing endpoint, the
+// cursors are omitted when there is no adjacent page
+type UsersResponse struct {
+	Users      []db.User `json:"users"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	PrevCursor string    `json:"prev_cursor,omitempty"`
+}
+
+// APIUsersHandler on request returns a page of the users stored by this
+// service as json, pages are selected with the cursor and limit parameters
+func (a *App) APIUsersHandler(w http.ResponseWriter, req *http.Request) {
+	cursor, limit, err := pageParams(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := a.db.GetUsersPage(cursor, limit)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Errorf("db GetUsersPage returned error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	users := page.Users
+	if users == nil {
+		users = []db.User{} // serialise as [] rather than null
+	}
+	writeJSON(w, http.StatusOK, UsersResponse{Users: users,
+		NextCursor: page.NextCursor, PrevCursor: page.PrevCursor})
+}
+
+// APIUserHandler on request returns a single user as json, or 404 if the
+// user is unknown to this service
+func (a *App) APIUserHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	user, err := a.db.GetUser(id)
+	if errors.Is(err, db.ErrUserNotFound) {
+		writeJSONError(w, http.StatusNotFound, "user "+id+" not found")
+		return
+	}
+	if err != nil {
+		log.Errorf("db GetUser returned error: %v, id: %s", err, id)
+		writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// HistoryResponse is the json body returned by the user history endpoint
+type HistoryResponse struct {
+	History []db.UserChange `json:"history"`
+}
+
+// APIUserHistoryHandler on request returns the recorded changes to a user as
+// json, most recent first
+func (a *App) APIUserHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	history, err := a.db.GetUserHistory(id)
+	if errors.Is(err, db.ErrUserNotFound) {
+		writeJSONError(w, http.StatusNotFound, "user "+id+" not found")
+		return
+	}
+	if err != nil {
+		log.Errorf("db GetUserHistory returned error: %v, id: %s", err, id)
+		writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	writeJSON(w, http.StatusOK, HistoryResponse{History: history})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("failed to marshal response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Internal Server Error"))
+		return
+	}
+	w.Header().Set(ContentType, MimeTypeJSON)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Status: status, Message: message})
+}
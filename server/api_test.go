@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func serve(a *App, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.newRouter().ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestAPIUsersHandler(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer(db.User{ID: "U2", Name: "bar"}, db.User{ID: "U1", Name: "foo"})
+	app := &App{db: storer}
+
+	w := serve(app, http.MethodGet, "/api/v1/users")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal(MimeTypeJSON, w.Header().Get(ContentType))
+
+	var resp UsersResponse
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	a.Equal([]db.User{{ID: "U1", Name: "foo"}, {ID: "U2", Name: "bar"}}, resp.Users)
+
+	// an empty table is an empty list rather than null
+	w = serve(&App{db: newFakeStorer()}, http.MethodGet, "/api/v1/users")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"users": []}`, w.Body.String())
+
+	w = serve(app, http.MethodGet, "/api/v1/users?limit=0")
+	a.Equal(http.StatusBadRequest, w.Code)
+	w = serve(app, http.MethodGet, "/api/v1/users?cursor=!!!")
+	a.Equal(http.StatusBadRequest, w.Code)
+
+	storer.err = errors.New("db down")
+	w = serve(app, http.MethodGet, "/api/v1/users")
+	a.Equal(http.StatusInternalServerError, w.Code)
+}
+
+func TestAPIUsersHandlerPagination(t *testing.T) {
+	a := assert.New(t)
+	app := &App{db: newFakeStorer(db.User{ID: "U1"}, db.User{ID: "U2"},
+		db.User{ID: "U3"}, db.User{ID: "U4"}, db.User{ID: "U5"})}
+
+	getPage := func(target string) UsersResponse {
+		w := serve(app, http.MethodGet, target)
+		a.Equal(http.StatusOK, w.Code)
+		var resp UsersResponse
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	ids := func(resp UsersResponse) []string {
+		var out []string
+		for _, u := range resp.Users {
+			out = append(out, u.ID)
+		}
+		return out
+	}
+
+	first := getPage("/api/v1/users?limit=2")
+	a.Equal([]string{"U1", "U2"}, ids(first))
+	a.Empty(first.PrevCursor)
+
+	second := getPage("/api/v1/users?limit=2&cursor=" + first.NextCursor)
+	a.Equal([]string{"U3", "U4"}, ids(second))
+
+	last := getPage("/api/v1/users?limit=2&cursor=" + second.NextCursor)
+	a.Equal([]string{"U5"}, ids(last))
+	a.Empty(last.NextCursor)
+
+	back := getPage("/api/v1/users?limit=2&cursor=" + last.PrevCursor)
+	a.Equal([]string{"U3", "U4"}, ids(back))
+	a.Equal(second, back)
+
+	back = getPage("/api/v1/users?limit=2&cursor=" + back.PrevCursor)
+	a.Equal([]string{"U1", "U2"}, ids(back))
+	a.Empty(back.PrevCursor)
+}
+
+func TestAPIUserHandler(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer(db.User{ID: "U1", Name: "foo", TZ: "GMT"})
+	app := &App{db: storer}
+
+	w := serve(app, http.MethodGet, "/api/v1/users/U1")
+	a.Equal(http.StatusOK, w.Code)
+	var user db.User
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &user))
+	a.Equal(db.User{ID: "U1", Name: "foo", TZ: "GMT"}, user)
+
+	w = serve(app, http.MethodGet, "/api/v1/users/U404")
+	a.Equal(http.StatusNotFound, w.Code)
+	var errResp ErrorResponse
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &errResp))
+	a.Equal(http.StatusNotFound, errResp.Status)
+
+	storer.err = errors.New("db down")
+	w = serve(app, http.MethodGet, "/api/v1/users/U1")
+	a.Equal(http.StatusInternalServerError, w.Code)
+}
+
+func TestAPIUserHistoryHandler(t *testing.T) {
+	a := assert.New(t)
+	created := db.User{ID: "U1", Name: "foo", ProfileStatusText: "working"}
+	updated := created
+	updated.ProfileStatusText = "on holiday"
+	storer := newFakeStorer(created)
+	app := &App{db: storer}
+	changed, err := storer.UpdateUser(updated, db.Origin{Source: db.SourceWebhook, EventID: "Ev1"})
+	a.NoError(err)
+	a.True(changed)
+	// writing identical data records no history
+	changed, err = storer.UpdateUser(updated, db.Origin{Source: db.SourceWebhook, EventID: "Ev2"})
+	a.NoError(err)
+	a.False(changed)
+
+	w := serve(app, http.MethodGet, "/api/v1/users/U1/history")
+	a.Equal(http.StatusOK, w.Code)
+	var resp HistoryResponse
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	a.Len(resp.History, 2)
+
+	latest := resp.History[0]
+	a.Equal(db.SourceWebhook, latest.Source)
+	a.Equal("Ev1", latest.EventID)
+	a.Equal(created, *latest.Old)
+	a.Equal(updated, *latest.New)
+	a.Equal([]db.FieldChange{{Field: "status_text", Old: "working", New: "on holiday"}},
+		latest.Fields())
+
+	first := resp.History[1]
+	a.Equal(db.SourceInitialSync, first.Source)
+	a.Nil(first.Old)
+
+	w = serve(app, http.MethodGet, "/api/v1/users/U404/history")
+	a.Equal(http.StatusNotFound, w.Code)
+
+	storer.err = errors.New("db down")
+	w = serve(app, http.MethodGet, "/api/v1/users/U1/history")
+	a.Equal(http.StatusInternalServerError, w.Code)
+}
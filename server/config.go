@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/backoff"
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/slack-go/slack"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultFetchTimeout is how long a fetch of every user from slack may take
+	DefaultFetchTimeout = 10 * time.Second
+	// DefaultResyncTimeout is how long a periodic resync may take
+	DefaultResyncTimeout = time.Minute
+	// DefaultDBConnectAttempts is how many times connecting to the database is
+	// tried at startup
+	DefaultDBConnectAttempts = 10
+	// DefaultBreakerThreshold is how many consecutive slack api calls must
+	// fail for us to stop calling slack
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long we stop calling slack for
+	DefaultBreakerCooldown = 30 * time.Second
+)
+
+// Config is the configuration of the service. LoadConfig builds it from
+// defaults, then a yaml file, then environment variables, then flags, each
+// overriding the last
+type Config struct {
+	Port string `yaml:"port"`
+	// Store is where users are stored, database or memory. postgres is
+	// accepted as database for configs written before other databases were
+	// supported
+	Store string `yaml:"store"`
+	// ShutdownTimeout is how long to wait for requests and queued events to
+	// finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// PprofAddr is the address pprof is served on, empty disables it
+	PprofAddr string `yaml:"pprof_addr"`
+
+	Slack    SlackConfig    `yaml:"slack"`
+	DB       DBConfig       `yaml:"db"`
+	HTTP     HTTPConfig     `yaml:"http"`
+	Sync     SyncConfig     `yaml:"sync"`
+	Webhooks WebhooksConfig `yaml:"webhooks"`
+}
+
+type SlackConfig struct {
+	APIToken      string `yaml:"api_token"`
+	APIURL        string `yaml:"api_url"`
+	SigningSecret string `yaml:"signing_secret"`
+	// VerificationToken is only used when VerificationTokenFallback is set as
+	// verification tokens are deprecated in favour of signing secrets
+	VerificationToken         string `yaml:"verification_token"`
+	VerificationTokenFallback bool   `yaml:"verification_token_fallback"`
+	Debug                     bool   `yaml:"debug"`
+
+	// the initial fetch of users is retried with exponential backoff, see
+	// backoff.Policy. RetryMaxAttempts 0 retries until shutdown
+	RetryBase        time.Duration `yaml:"retry_base"`
+	RetryMax         time.Duration `yaml:"retry_max"`
+	RetryJitter      float64       `yaml:"retry_jitter"`
+	RetryMaxAttempts int           `yaml:"retry_max_attempts"`
+	// slack is not called for BreakerCooldown once BreakerThreshold calls in a
+	// row have failed
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+}
+
+// retryPolicy returns the backoff policy for retrying calls to slack
+func (c SlackConfig) retryPolicy() backoff.Policy {
+	return backoff.Policy{
+		Base:        c.RetryBase,
+		Max:         c.RetryMax,
+		Jitter:      c.RetryJitter,
+		MaxAttempts: c.RetryMaxAttempts,
+	}
+}
+
+type DBConfig struct {
+	// ConnectionString selects the database, see db.ParseConnectionString
+	ConnectionString string        `yaml:"connection_string"`
+	ConnectAttempts  int           `yaml:"connect_attempts"`
+	ConnectInterval  time.Duration `yaml:"connect_interval"`
+}
+
+type HTTPConfig struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+type SyncConfig struct {
+	// Interval is how often users are reconciled against slack, 0 disables it
+	Interval      time.Duration `yaml:"interval"`
+	FetchTimeout  time.Duration `yaml:"fetch_timeout"`
+	ResyncTimeout time.Duration `yaml:"resync_timeout"`
+	// MaxAge is how long since the last successful sync we report ready for,
+	// 0 is three intervals
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type WebhooksConfig struct {
+	// DedupTTL is how long processed events are remembered
+	DedupTTL time.Duration `yaml:"dedup_ttl"`
+	// ReplayWindow is how far a request timestamp may drift from our clock
+	ReplayWindow time.Duration `yaml:"replay_window"`
+	QueueSize    int           `yaml:"queue_size"`
+	QueueWorkers int           `yaml:"queue_workers"`
+}
+
+// DefaultConfig returns the configuration used for settings which are not
+// given in a file, the environment or flags
+func DefaultConfig() Config {
+	return Config{
+		Port:            DefaultPortNum,
+		Store:           "database",
+		ShutdownTimeout: DefaultShutdownTimeout,
+		PprofAddr:       ":6060",
+		Slack: SlackConfig{
+			APIURL:           slack.APIURL,
+			Debug:            true,
+			RetryBase:        time.Second,
+			RetryMax:         time.Minute,
+			RetryJitter:      0.5,
+			BreakerThreshold: DefaultBreakerThreshold,
+			BreakerCooldown:  DefaultBreakerCooldown,
+		},
+		DB: DBConfig{
+			ConnectAttempts: DefaultDBConnectAttempts,
+			ConnectInterval: time.Second,
+		},
+		HTTP: HTTPConfig{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		},
+		Sync: SyncConfig{
+			Interval:      DefaultSyncInterval,
+			FetchTimeout:  DefaultFetchTimeout,
+			ResyncTimeout: DefaultResyncTimeout,
+		},
+		Webhooks: WebhooksConfig{
+			DedupTTL:     DefaultEventTTL,
+			ReplayWindow: DefaultReplayWindow,
+			QueueSize:    DefaultQueueSize,
+			QueueWorkers: DefaultQueueWorkers,
+		},
+	}
+}
+
+// setting is a Config field which can be set by an environment variable and,
+// unless it is a secret, a flag
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	// target points to the Config field, a *string, *bool, *int, *float64 or
+	// *time.Duration
+	target interface{}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"PORT", "port", "TCP/IP port that this program listens on", &c.Port},
+		{"STORE", "store", "where users are stored, database or memory", &c.Store},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to wait for work to finish on shutdown", &c.ShutdownTimeout},
+		{"PPROF_ADDR", "pprof-addr", "address pprof is served on, empty disables it", &c.PprofAddr},
+
+		{"SLACK_API_TOKEN", "", "", &c.Slack.APIToken},
+		{"SLACK_API_URL", "slack-api-url", "url of the slack api", &c.Slack.APIURL},
+		{"SLACK_SIGNING_SECRET", "", "", &c.Slack.SigningSecret},
+		{"SLACK_VERIFICATION_TOKEN", "", "", &c.Slack.VerificationToken},
+		{"SLACK_VERIFICATION_TOKEN_FALLBACK", "slack-verification-token-fallback",
+			"accept unsigned requests carrying the verification token", &c.Slack.VerificationTokenFallback},
+		{"SLACK_DEBUG", "slack-debug", "log slack api requests", &c.Slack.Debug},
+		{"SLACK_RETRY_BASE", "slack-retry-base", "delay before the first retry of a failed slack call",
+			&c.Slack.RetryBase},
+		{"SLACK_RETRY_MAX", "slack-retry-max", "maximum delay between retries of failed slack calls",
+			&c.Slack.RetryMax},
+		{"SLACK_RETRY_JITTER", "slack-retry-jitter", "fraction of each retry delay which is randomised, 0 to 1",
+			&c.Slack.RetryJitter},
+		{"SLACK_RETRY_MAX_ATTEMPTS", "slack-retry-max-attempts", "how many times to try fetching users, 0 is unlimited",
+			&c.Slack.RetryMaxAttempts},
+		{"SLACK_BREAKER_THRESHOLD", "slack-breaker-threshold", "consecutive slack failures before we stop calling it",
+			&c.Slack.BreakerThreshold},
+		{"SLACK_BREAKER_COOLDOWN", "slack-breaker-cooldown", "how long we stop calling slack for after failures",
+			&c.Slack.BreakerCooldown},
+
+		// connection strings usually hold a password so have no flag
+		{"DB_CONNECTION_STRING", "", "", &c.DB.ConnectionString},
+		{"DB_CONNECT_ATTEMPTS", "db-connect-attempts", "how many times to try connecting to the database",
+			&c.DB.ConnectAttempts},
+		{"DB_CONNECT_INTERVAL", "db-connect-interval", "how long to wait between database connection attempts",
+			&c.DB.ConnectInterval},
+
+		{"HTTP_READ_TIMEOUT", "http-read-timeout", "http server read timeout", &c.HTTP.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", "http-write-timeout", "http server write timeout", &c.HTTP.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", "http-idle-timeout", "http server idle timeout", &c.HTTP.IdleTimeout},
+
+		{"SYNC_INTERVAL", "sync-interval", "how often users are reconciled against slack, 0 disables it",
+			&c.Sync.Interval},
+		{"FETCH_TIMEOUT", "fetch-timeout", "how long fetching users from slack may take", &c.Sync.FetchTimeout},
+		{"RESYNC_TIMEOUT", "resync-timeout", "how long a periodic resync may take", &c.Sync.ResyncTimeout},
+		{"SYNC_MAX_AGE", "sync-max-age", "how long since the last successful sync we report ready for, 0 is three intervals",
+			&c.Sync.MaxAge},
+
+		{"EVENT_DEDUP_TTL", "event-dedup-ttl", "how long processed webhook events are remembered",
+			&c.Webhooks.DedupTTL},
+		{"WEBHOOK_REPLAY_WINDOW", "webhook-replay-window", "how far a request timestamp may drift from our clock",
+			&c.Webhooks.ReplayWindow},
+		{"WEBHOOK_QUEUE_SIZE", "webhook-queue-size", "how many webhook events can wait to be written",
+			&c.Webhooks.QueueSize},
+		{"WEBHOOK_QUEUE_WORKERS", "webhook-queue-workers", "how many webhook events are written concurrently",
+			&c.Webhooks.QueueWorkers},
+	}
+}
+
+// set parses value into the setting's Config field
+func (s setting) set(value string) error {
+	var err error
+	switch target := s.target.(type) {
+	case *string:
+		*target = value
+	case *bool:
+		*target, err = strconv.ParseBool(value)
+	case *int:
+		*target, err = strconv.Atoi(value)
+	case *float64:
+		*target, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*target, err = time.ParseDuration(value)
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", s.target))
+	}
+	return err
+}
+
+// flagValue records the value of a flag so it can be applied after the file
+// and environment
+type flagValue struct {
+	setting setting
+	value   *string
+}
+
+func (f flagValue) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f flagValue) Set(value string) error {
+	// parse the value now so flag reports errors along with usage, setting
+	// points into a scratch Config so this has no other effect
+	if err := f.setting.set(value); err != nil {
+		return err
+	}
+	*f.value = value
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	_, ok := f.setting.target.(*bool)
+	return ok
+}
+
+// LoadConfig returns the configuration given by defaults, the yaml file named
+// by the -config flag or CONFIG_FILE, environment variables and flags, in
+// increasing order of precedence, along with the arguments after the flags.
+// lookupEnv is os.LookupEnv outside of tests, a variable which is set but
+// empty overrides the setting, e.g. PPROF_ADDR= disables pprof. The config is
+// not validated, call Validate
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, []string, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	defaultConfigFile, _ := lookupEnv("CONFIG_FILE")
+	configFile := fs.String("config", defaultConfigFile, "path to a yaml config file")
+	flagValues := map[string]*string{}
+	var scratch Config
+	for _, s := range scratch.settings() {
+		if s.flag == "" {
+			continue
+		}
+		value := new(string)
+		flagValues[s.flag] = value
+		fs.Var(flagValue{setting: s, value: value}, s.flag, s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	cfg := DefaultConfig()
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	settings := cfg.settings()
+	for _, s := range settings {
+		value, ok := lookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		if err := s.set(value); err != nil {
+			return Config{}, nil, fmt.Errorf("invalid %s %q: %v", s.env, value, err)
+		}
+	}
+
+	// only flags which were passed override the file and environment
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.set(*flagValues[f.Name])
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// loadFile overrides the config with the settings in a yaml file, unknown
+// settings are an error so that typos are not silently ignored
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate returns an error describing every invalid setting
+func (c Config) Validate() error {
+	var problems []string
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %q must be a number between 1 and 65535", c.Port))
+	}
+	switch c.Store {
+	case "memory":
+	case "database", "postgres": // postgres is kept for older configs
+		if _, _, err := db.ParseConnectionString(c.DB.ConnectionString); err != nil {
+			problems = append(problems, fmt.Sprintf("db connection string: %v", err))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("store %q must be database or memory", c.Store))
+	}
+	if c.DB.ConnectAttempts < 1 {
+		problems = append(problems, "db connect attempts must be at least 1")
+	}
+	if c.Slack.RetryJitter < 0 || c.Slack.RetryJitter > 1 {
+		problems = append(problems, "slack retry jitter must be between 0 and 1")
+	}
+	if c.Slack.RetryMaxAttempts < 0 {
+		problems = append(problems, "slack retry max attempts must not be negative")
+	}
+	if c.Slack.BreakerThreshold < 1 {
+		problems = append(problems, "slack breaker threshold must be at least 1")
+	}
+	if c.Webhooks.QueueSize < 1 {
+		problems = append(problems, "webhook queue size must be at least 1")
+	}
+	if c.Webhooks.QueueWorkers < 1 {
+		problems = append(problems, "webhook queue workers must be at least 1")
+	}
+
+	positive := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"shutdown timeout", c.ShutdownTimeout},
+		{"http read timeout", c.HTTP.ReadTimeout},
+		{"http write timeout", c.HTTP.WriteTimeout},
+		{"http idle timeout", c.HTTP.IdleTimeout},
+		{"fetch timeout", c.Sync.FetchTimeout},
+		{"slack retry base", c.Slack.RetryBase},
+		{"slack retry max", c.Slack.RetryMax},
+		{"slack breaker cooldown", c.Slack.BreakerCooldown},
+		{"resync timeout", c.Sync.ResyncTimeout},
+		{"event dedup ttl", c.Webhooks.DedupTTL},
+		{"webhook replay window", c.Webhooks.ReplayWindow},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", p.name))
+		}
+	}
+	if c.Sync.Interval < 0 {
+		problems = append(problems, "sync interval must not be negative")
+	}
+	if c.Sync.MaxAge < 0 {
+		problems = append(problems, "sync max age must not be negative")
+	}
+	if c.DB.ConnectInterval < 0 {
+		problems = append(problems, "db connect interval must not be negative")
+	}
+
+	if c.Slack.APIToken == "" {
+		problems = append(problems, "SLACK_API_TOKEN must be set")
+	}
+	if c.Slack.APIURL == "" {
+		problems = append(problems, "slack api url must be set")
+	}
+	if c.Slack.SigningSecret == "" &&
+		!(c.Slack.VerificationTokenFallback && c.Slack.VerificationToken != "") {
+		problems = append(problems, "SLACK_SIGNING_SECRET must be set")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// durationOrDefault returns d, or def if d is not set, for Apps which were not
+// initialised from a Config
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
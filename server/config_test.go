@@ -0,0 +1,173 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// env returns a lookupEnv func backed by a map
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := vars[key]
+		return value, ok
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	a := assert.New(t)
+	cfg, args, err := LoadConfig(nil, env(nil))
+	a.NoError(err)
+	a.Empty(args)
+	a.Equal(DefaultConfig(), cfg)
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	// the example documents the defaults so must stay in step with them
+	cfg, _, err := LoadConfig([]string{"-config", "../config.example.yaml"}, env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	a.NoError(os.WriteFile(path, []byte(`
+port: "4000"
+store: memory
+sync:
+  interval: 5m
+  fetch_timeout: 30s
+webhooks:
+  queue_size: 10
+  queue_workers: 2
+`), 0600))
+
+	cfg, args, err := LoadConfig([]string{"-config", path, "-port", "5000", "-webhook-queue-workers", "8",
+		"migrate", "up"}, env(map[string]string{
+		"PORT":            "4500",
+		"SYNC_INTERVAL":   "10m",
+		"SLACK_API_TOKEN": "xoxb-token",
+	}))
+	a.NoError(err)
+	a.Equal([]string{"migrate", "up"}, args)
+
+	// flags override the environment, which overrides the file
+	a.Equal("5000", cfg.Port)
+	a.Equal(10*time.Minute, cfg.Sync.Interval)
+	a.Equal(8, cfg.Webhooks.QueueWorkers)
+	// settings only given in the file are kept
+	a.Equal("memory", cfg.Store)
+	a.Equal(30*time.Second, cfg.Sync.FetchTimeout)
+	a.Equal(10, cfg.Webhooks.QueueSize)
+	a.Equal("xoxb-token", cfg.Slack.APIToken)
+	// and everything else is defaulted
+	a.Equal(DefaultResyncTimeout, cfg.Sync.ResyncTimeout)
+	a.Equal(DefaultEventTTL, cfg.Webhooks.DedupTTL)
+}
+
+func TestLoadConfigEmptyEnv(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	a.NoError(os.WriteFile(path, []byte("pprof_addr: localhost:6060\n"), 0600))
+
+	// a variable which is set but empty overrides the file and default
+	cfg, _, err := LoadConfig([]string{"-config", path}, env(map[string]string{"PPROF_ADDR": ""}))
+	a.NoError(err)
+	a.Equal("", cfg.PprofAddr)
+
+	cfg, _, err = LoadConfig([]string{"-config", path}, env(nil))
+	a.NoError(err)
+	a.Equal("localhost:6060", cfg.PprofAddr)
+}
+
+func TestLoadConfigConfigFileFromEnv(t *testing.T) {
+	a := assert.New(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	a.NoError(os.WriteFile(path, []byte("slack:\n  debug: false\n"), 0600))
+
+	cfg, _, err := LoadConfig(nil, env(map[string]string{"CONFIG_FILE": path}))
+	a.NoError(err)
+	a.False(cfg.Slack.Debug)
+
+	// a bool flag needs no value
+	cfg, _, err = LoadConfig([]string{"-slack-debug"}, env(map[string]string{"CONFIG_FILE": path}))
+	a.NoError(err)
+	a.True(cfg.Slack.Debug)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("sync:\n  intervl: 5m\n"), 0600))
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"invalid env", nil, map[string]string{"SYNC_INTERVAL": "hourly"}},
+		{"empty env", nil, map[string]string{"WEBHOOK_QUEUE_SIZE": ""}},
+		{"invalid flag", []string{"-webhook-queue-size", "lots"}, nil},
+		{"unknown flag", []string{"-prot", "3000"}, nil},
+		{"missing file", []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, nil},
+		{"unknown file setting", []string{"-config", path}, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := LoadConfig(tt.args, env(tt.env))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.Slack.APIToken = "xoxb-token"
+	valid.Slack.SigningSecret = "secret"
+	assert.NoError(t, valid.Validate())
+	// postgres was the store before other databases were supported
+	legacy := valid
+	legacy.Store = "postgres"
+	assert.NoError(t, legacy.Validate())
+
+	tests := []struct {
+		name   string
+		mutate func(*Config)
+	}{
+		{"port", func(c *Config) { c.Port = "http" }},
+		{"port out of range", func(c *Config) { c.Port = "70000" }},
+		{"store", func(c *Config) { c.Store = "redis" }},
+		{"db connection string", func(c *Config) { c.DB.ConnectionString = "mysql://%zz" }},
+		{"db connect attempts", func(c *Config) { c.DB.ConnectAttempts = 0 }},
+		{"queue size", func(c *Config) { c.Webhooks.QueueSize = 0 }},
+		{"queue workers", func(c *Config) { c.Webhooks.QueueWorkers = -1 }},
+		{"fetch timeout", func(c *Config) { c.Sync.FetchTimeout = 0 }},
+		{"sync interval", func(c *Config) { c.Sync.Interval = -time.Second }},
+		{"api token", func(c *Config) { c.Slack.APIToken = "" }},
+		{"signing secret", func(c *Config) { c.Slack.SigningSecret = "" }},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.mutate(&cfg)
+			assert.Error(t, cfg.Validate())
+		})
+	}
+
+	// the verification token can stand in for the signing secret
+	cfg := valid
+	cfg.Slack.SigningSecret = ""
+	cfg.Slack.VerificationTokenFallback = true
+	cfg.Slack.VerificationToken = "token"
+	assert.NoError(t, cfg.Validate())
+	// and the memory store needs no database
+	cfg = valid
+	cfg.Store = "memory"
+	cfg.DB.ConnectionString = "mysql://%zz"
+	assert.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cocoonlife/timber"
+)
+
+// DefaultEventTTL is how long processed webhook events are remembered, slack
+// retries a failed delivery three times over about five minutes
+const DefaultEventTTL = time.Hour
+
+const (
+	// HeaderSlackRetryNum is set by slack on redeliveries of an event
+	HeaderSlackRetryNum = "X-Slack-Retry-Num"
+	// HeaderSlackRetryReason is why slack redelivered an event
+	HeaderSlackRetryReason = "X-Slack-Retry-Reason"
+)
+
+// WebhookStats counts webhook event deliveries since the service started
+type WebhookStats struct {
+	// Received is the number of verified event deliveries
+	Received int64 `json:"received"`
+	// Retries is the number of deliveries slack marked as retries
+	Retries int64 `json:"retries"`
+	// Duplicates is the number of deliveries whose event had already been
+	// processed
+	Duplicates int64 `json:"duplicates"`
+}
+
+// webhookCounters accumulates WebhookStats, it is safe for concurrent use
+type webhookCounters struct {
+	received   int64
+	retries    int64
+	duplicates int64
+}
+
+func (c *webhookCounters) stats() WebhookStats {
+	return WebhookStats{
+		Received:   atomic.LoadInt64(&c.received),
+		Retries:    atomic.LoadInt64(&c.retries),
+		Duplicates: atomic.LoadInt64(&c.duplicates),
+	}
+}
+
+// countDelivery counts a verified event delivery and whether it was a retry
+func (a *App) countDelivery(req *http.Request, eventID string) {
+	atomic.AddInt64(&a.webhooks.received, 1)
+	if retry := req.Header.Get(HeaderSlackRetryNum); retry != "" {
+		atomic.AddInt64(&a.webhooks.retries, 1)
+		log.Infof("event %s is retry %s from slack, reason: %s", eventID, retry,
+			req.Header.Get(HeaderSlackRetryReason))
+	}
+}
+
+// claimEvent records that an event has been processed and reports whether it
+// had not been already. Events whose claim cannot be recorded are treated as
+// new, their retries are written again which is harmless
+func (a *App) claimEvent(eventID string) bool {
+	if eventID == "" {
+		return true
+	}
+
+	claimed, err := a.db.ClaimEvent(eventID, time.Now().Add(a.eventTTL()))
+	if err != nil {
+		log.Errorf("failed to claim event %s: %v", eventID, err)
+		return true
+	}
+	if !claimed {
+		atomic.AddInt64(&a.webhooks.duplicates, 1)
+		log.Infof("event %s had already been processed", eventID)
+	}
+	return claimed
+}
+
+// eventTTL returns how long processed events are remembered
+func (a *App) eventTTL() time.Duration {
+	return durationOrDefault(a.dedupTTL, DefaultEventTTL)
+}
+
+// APIWebhookStatsHandler on request returns counts of webhook deliveries,
+// including retries which were skipped as duplicates, as json
+func (a *App) APIWebhookStatsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, a.webhooks.stats())
+}
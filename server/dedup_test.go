@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooksHandlerDeduplicatesRetries(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateUpdateEventAt(user, "", "Ev01", time.Now())
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+
+	// slack retries the event, e.g. as we were slow to respond
+	header := signedHeader(testSigningSecret, time.Now(), body)
+	header.Set(HeaderSlackRetryNum, "1")
+	header.Set(HeaderSlackRetryReason, "http_timeout")
+	w = postWebhook(app, header, body)
+	a.Equal(http.StatusOK, w.Code)
+
+	history, err := storer.GetUserHistory("U1")
+	a.NoError(err)
+	a.Len(history, 1)
+
+	w = serve(app, http.MethodGet, "/api/v1/webhooks/stats")
+	a.Equal(http.StatusOK, w.Code)
+	var stats WebhookStats
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &stats))
+	a.Equal(WebhookStats{Received: 2, Retries: 1, Duplicates: 1}, stats)
+}
+
+// TestWebhooksHandlerReplaysFailedEvents checks an event whose write fails
+// after slack was acknowledged, which slack will not retry, is not recorded as
+// processed and is recovered by replaying it from the inbox
+func TestWebhooksHandlerReplaysFailedEvents(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateUpdateEventAt(user, "", "Ev01", time.Now())
+	storer.writeErr = errors.New("db down")
+	received := time.Now()
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+	_, err := storer.GetUser("U1")
+	a.Equal(db.ErrUserNotFound, err)
+
+	// events received since the replay cutoff may still be queued
+	storer.writeErr = nil
+	replayed, err := app.ReplayEvents(received)
+	a.NoError(err)
+	a.Equal(0, replayed)
+
+	replayed, err = app.ReplayEvents(time.Now())
+	a.NoError(err)
+	a.Equal(1, replayed)
+	stored, err := storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(user), stored)
+	a.Equal(WebhookStats{Received: 1}, app.webhooks.stats())
+}
+
+func TestEventTTL(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(DefaultEventTTL, (&App{}).eventTTL())
+	a.Equal(time.Minute, (&App{dedupTTL: time.Minute}).eventTTL())
+}
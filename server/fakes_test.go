@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/slack-go/slack"
+)
+
+// fakeStorer is an in memory Storer used to unit test handlers, setting err
+// makes every call fail and setting writeErr makes writes of users fail
+type fakeStorer struct {
+	*db.Memory
+	err      error
+	writeErr error
+}
+
+func newFakeStorer(users ...db.User) *fakeStorer {
+	f := &fakeStorer{Memory: db.NewMemory()}
+	f.Memory.CreateUsers(users, db.Origin{Source: db.SourceInitialSync})
+	return f
+}
+
+func (f *fakeStorer) CreateUsers(users []db.User, origin db.Origin) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
+	return f.Memory.CreateUsers(users, origin)
+}
+
+func (f *fakeStorer) UpdateUser(user db.User, origin db.Origin) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	if f.writeErr != nil {
+		return false, f.writeErr
+	}
+	return f.Memory.UpdateUser(user, origin)
+}
+
+func (f *fakeStorer) GetUsersPage(cursor string, limit int) (db.Page, error) {
+	if f.err != nil {
+		return db.Page{}, f.err
+	}
+	return f.Memory.GetUsersPage(cursor, limit)
+}
+
+func (f *fakeStorer) GetUser(id string) (db.User, error) {
+	if f.err != nil {
+		return db.User{}, f.err
+	}
+	return f.Memory.GetUser(id)
+}
+
+func (f *fakeStorer) GetUserHistory(id string) ([]db.UserChange, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.Memory.GetUserHistory(id)
+}
+
+func (f *fakeStorer) CountUsers() (int, int, error) {
+	if f.err != nil {
+		return 0, 0, f.err
+	}
+	return f.Memory.CountUsers()
+}
+
+func (f *fakeStorer) Ping(ctx context.Context) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.Memory.Ping(ctx)
+}
+
+func (f *fakeStorer) ClaimEvent(eventID string, expires time.Time) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	return f.Memory.ClaimEvent(eventID, expires)
+}
+
+func (f *fakeStorer) SaveEvent(eventID string, payload []byte) (int64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.Memory.SaveEvent(eventID, payload)
+}
+
+func (f *fakeStorer) CompleteEvent(id int64) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.Memory.CompleteEvent(id)
+}
+
+func (f *fakeStorer) PendingEvents() ([]db.InboxEvent, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.Memory.PendingEvents()
+}
+
+func (f *fakeStorer) PruneEvents(before time.Time) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.Memory.PruneEvents(before)
+}
+
+// fakeSlacker is an in memory Slacker. Calls return errs in order until they
+// are used up, a nil entry returning the page asked for, and then pages of
+// users, pageSize at a time if set
+type fakeSlacker struct {
+	mu       sync.Mutex
+	users    []slack.User
+	errs     []error
+	pageSize int
+	calls    int
+}
+
+func (f *fakeSlacker) GetUsersPage(ctx context.Context, cursor string) ([]slack.User, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	start, _ := strconv.Atoi(cursor)
+	end := len(f.users)
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+	var next string
+	if end < len(f.users) {
+		next = strconv.Itoa(end)
+	}
+	return append([]slack.User{}, f.users[start:end]...), next, nil
+}
+
+// callCount returns how many calls slack has been sent
+func (f *fakeSlacker) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *fakeSlacker) setUsers(users []slack.User) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users = users
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cocoonlife/timber"
+)
+
+// readyDBTimeout bounds the database ping made by the readiness check
+const readyDBTimeout = 2 * time.Second
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// HealthResponse is the json body returned by the health check endpoints,
+// Status is unavailable if any of the checks failed
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthHandler reports that the process is alive, it does not depend on
+// anything else so that an orchestrator does not restart us because a
+// dependency is down
+func (a *App) HealthHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: StatusOK})
+}
+
+// ReadyHandler reports whether we should be sent traffic, that is the
+// database is reachable, users have been fetched from slack and the last
+// successful sync with slack is recent enough. It responds 503 otherwise
+func (a *App) ReadyHandler(w http.ResponseWriter, req *http.Request) {
+	checks := map[string]CheckResult{
+		"database":     a.checkDatabase(req.Context()),
+		"initial_sync": a.checkInitialSync(),
+	}
+	if a.syncInterval > 0 {
+		checks["sync_age"] = a.checkSyncAge()
+	}
+
+	resp := HealthResponse{Status: StatusOK, Checks: checks}
+	status := http.StatusOK
+	for name, check := range checks {
+		if check.Status != StatusOK {
+			log.Warnf("readiness check %s failed: %s", name, check.Message)
+			resp.Status = StatusUnavailable
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+func (a *App) checkDatabase(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, readyDBTimeout)
+	defer cancel()
+	if err := a.db.Ping(ctx); err != nil {
+		return CheckResult{Status: StatusUnavailable, Message: err.Error()}
+	}
+	return CheckResult{Status: StatusOK}
+}
+
+func (a *App) checkInitialSync() CheckResult {
+	if a.lastSyncTime().IsZero() {
+		return CheckResult{Status: StatusUnavailable, Message: "users have not been fetched from slack yet"}
+	}
+	return CheckResult{Status: StatusOK}
+}
+
+// checkSyncAge fails when several resyncs in a row have failed, by default
+// three, as users are then likely to have drifted from slack
+func (a *App) checkSyncAge() CheckResult {
+	last := a.lastSyncTime()
+	if last.IsZero() {
+		// reported by checkInitialSync
+		return CheckResult{Status: StatusOK}
+	}
+	age := time.Since(last).Round(time.Second)
+	maxAge := durationOrDefault(a.maxSyncAge, 3*a.syncInterval)
+	if age > maxAge {
+		return CheckResult{Status: StatusUnavailable,
+			Message: fmt.Sprintf("last successful sync was %s ago, more than %s", age, maxAge)}
+	}
+	return CheckResult{Status: StatusOK, Message: fmt.Sprintf("last successful sync was %s ago", age)}
+}
+
+// syncSucceeded records when users were last successfully synced with slack
+func (a *App) syncSucceeded() {
+	atomic.StoreInt64(&a.lastSync, time.Now().UnixNano())
+}
+
+// lastSyncTime returns when users were last successfully synced with slack,
+// or the zero time if they never have been
+func (a *App) lastSyncTime() time.Time {
+	last := atomic.LoadInt64(&a.lastSync)
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	storer.err = errors.New("db down")
+	app := newTestApp(t, storer)
+
+	// liveness does not depend on the database
+	for _, path := range []string{"/health", "/healthz"} {
+		w := serve(app, http.MethodGet, path)
+		a.Equal(http.StatusOK, w.Code)
+		a.JSONEq(`{"status": "ok"}`, w.Body.String())
+	}
+}
+
+func readyz(t *testing.T, app *App) (int, HealthResponse) {
+	w := serve(app, http.MethodGet, "/readyz")
+	var resp HealthResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return w.Code, resp
+}
+
+func TestReadyHandler(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	slacker := &fakeSlacker{users: generateUsers(3)}
+	app := newTestApp(t, storer)
+	app.slackClient = slacker
+	app.syncInterval = time.Hour
+
+	// not ready until users have been fetched from slack
+	code, resp := readyz(t, app)
+	a.Equal(http.StatusServiceUnavailable, code)
+	a.Equal(StatusUnavailable, resp.Status)
+	a.Equal(StatusOK, resp.Checks["database"].Status)
+	a.Equal(StatusUnavailable, resp.Checks["initial_sync"].Status)
+
+	a.NoError(app.FetchUsers(context.Background()))
+	code, resp = readyz(t, app)
+	a.Equal(http.StatusOK, code)
+	a.Equal(StatusOK, resp.Status)
+	for name, check := range resp.Checks {
+		a.Equal(StatusOK, check.Status, name)
+	}
+
+	// resyncs have been failing for longer than three intervals
+	app.lastSync = time.Now().Add(-4 * time.Hour).UnixNano()
+	code, resp = readyz(t, app)
+	a.Equal(http.StatusServiceUnavailable, code)
+	a.Equal(StatusUnavailable, resp.Checks["sync_age"].Status)
+	a.Equal(StatusOK, resp.Checks["initial_sync"].Status)
+
+	// a successful resync makes us ready again
+	_, err := app.Resync(context.Background())
+	a.NoError(err)
+	code, _ = readyz(t, app)
+	a.Equal(http.StatusOK, code)
+
+	// the database is down
+	storer.err = errors.New("db down")
+	code, resp = readyz(t, app)
+	a.Equal(http.StatusServiceUnavailable, code)
+	a.Equal(CheckResult{Status: StatusUnavailable, Message: "db down"}, resp.Checks["database"])
+}
+
+func TestReadyHandlerWithoutResync(t *testing.T) {
+	a := assert.New(t)
+	app := newTestApp(t, newFakeStorer())
+	app.lastSync = time.Now().Add(-24 * 365 * time.Hour).UnixNano()
+
+	// the sync age is not checked when periodic resync is disabled
+	code, resp := readyz(t, app)
+	a.Equal(http.StatusOK, code)
+	a.NotContains(resp.Checks, "sync_age")
+}
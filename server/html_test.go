@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTemplates points the html handlers at the templates in the repo root for
+// the duration of a test
+func useTemplates(t *testing.T, dir string) {
+	old := templateDir
+	templateDir = dir
+	t.Cleanup(func() { templateDir = old })
+}
+
+func TestUsersHandler(t *testing.T) {
+	a := assert.New(t)
+	useTemplates(t, "../html")
+	storer := newFakeStorer(db.User{ID: "U1", Name: "foo", RealName: "<script>alert(1)</script>"})
+	app := &App{db: storer}
+
+	w := serve(app, http.MethodGet, "/users")
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `<a href="/users/U1/history">U1</a>`)
+	a.Contains(w.Body.String(), "&lt;script&gt;alert(1)&lt;/script&gt;")
+	a.NotContains(w.Body.String(), "<script>")
+}
+
+func TestUsersHandlerMissingTemplate(t *testing.T) {
+	a := assert.New(t)
+	useTemplates(t, t.TempDir())
+	app := &App{db: newFakeStorer(db.User{ID: "U1", Name: "foo"})}
+
+	w := serve(app, http.MethodGet, "/users")
+	a.Equal(http.StatusInternalServerError, w.Code)
+	a.Equal("500 - Internal Server Error", w.Body.String())
+}
+
+func TestUserHistoryHandler(t *testing.T) {
+	a := assert.New(t)
+	useTemplates(t, "../html")
+	created := db.User{ID: "U1", Name: "foo", ProfileStatusText: "working"}
+	updated := created
+	updated.ProfileStatusText = "<script>alert(1)</script>"
+	storer := newFakeStorer(created)
+	app := &App{db: storer}
+	_, err := storer.UpdateUser(updated, db.Origin{Source: db.SourceWebhook, EventID: "Ev1"})
+	a.NoError(err)
+
+	w := serve(app, http.MethodGet, "/users/U1/history")
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), "status_text: working &rarr; &lt;script&gt;alert(1)&lt;/script&gt;")
+	a.NotContains(w.Body.String(), "<script>")
+
+	w = serve(app, http.MethodGet, "/users/U404/history")
+	a.Equal(http.StatusNotFound, w.Code)
+
+	useTemplates(t, t.TempDir())
+	w = serve(app, http.MethodGet, "/users/U1/history")
+	a.Equal(http.StatusInternalServerError, w.Code)
+	a.Equal("500 - Internal Server Error", w.Body.String())
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"time"
+
+	log "github.com/cocoonlife/timber"
+	"github.com/slack-go/slack/slackevents"
+)
+
+// processUserEvent writes the user from an event taken off the queue and
+// marks the event processed in the inbox. The event is only recorded as
+// processed once the user is written, so an event interrupted part way is
+// written when it is replayed rather than skipped as a duplicate. Writing an
+// event twice is harmless as unchanged and older users are not written.
+// Events which fail are left in the inbox to be replayed
+func (a *App) processUserEvent(ev userEvent) {
+	outcome, err := a.updateUser(ev)
+	if err != nil {
+		webhookEvents.WithLabelValues(ev.eventType, outcome).Inc()
+		return
+	}
+	if !a.claimEvent(ev.origin.EventID) {
+		// slack retried an event we have already processed
+		outcome = outcomeDuplicate
+	}
+	webhookEvents.WithLabelValues(ev.eventType, outcome).Inc()
+	a.completeEvent(ev.inboxID)
+}
+
+func (a *App) completeEvent(inboxID int64) {
+	if err := a.db.CompleteEvent(inboxID); err != nil {
+		// the event will be replayed, which is harmless as it is deduplicated
+		log.Errorf("failed to mark inbox event %d processed: %v", inboxID, err)
+	}
+}
+
+// ReplayEvents processes the events left unprocessed in the inbox which were
+// received before the given time, e.g. because the service stopped after
+// acknowledging them or their write failed, and returns how many were
+// replayed. Recent events are left alone as they may still be queued
+func (a *App) ReplayEvents(before time.Time) (int, error) {
+	events, err := a.db.PendingEvents()
+	if err != nil {
+		return 0, err
+	}
+	var replayed int
+	for _, inboxEvent := range events {
+		if !inboxEvent.ReceivedAt.Before(before) {
+			continue
+		}
+		replayed++
+		event, err := slackevents.ParseEvent(inboxEvent.Payload, slackevents.OptionNoVerifyToken())
+		if err != nil {
+			// the payload was parsed before it was saved so this should not happen
+			log.Errorf("failed to parse inbox event %d: %v", inboxEvent.ID, err)
+			a.completeEvent(inboxEvent.ID)
+			continue
+		}
+		ev, ok, err := userEventFromCallback(event)
+		if err != nil {
+			log.Errorf("failed to read user from inbox event %d: %v", inboxEvent.ID, err)
+		}
+		if !ok {
+			a.completeEvent(inboxEvent.ID)
+			continue
+		}
+		ev.inboxID = inboxEvent.ID
+		log.Infof("replaying event %s received at %s", ev.origin.EventID, inboxEvent.ReceivedAt)
+		a.processUserEvent(ev)
+	}
+	return replayed, nil
+}
+
+// replayInbox replays unprocessed inbox events received before the given time
+// and prunes processed ones
+func (a *App) replayInbox(before time.Time) {
+	replayed, err := a.ReplayEvents(before)
+	if err != nil {
+		log.Errorf("failed to replay inbox: %v", err)
+	} else if replayed > 0 {
+		log.Infof("replayed %d unprocessed events from inbox", replayed)
+	}
+	a.pruneInbox()
+}
+
+// pruneInbox deletes processed inbox events older than the dedup ttl, by
+// when slack will have stopped retrying them
+func (a *App) pruneInbox() {
+	pruned, err := a.db.PruneEvents(time.Now().Add(-a.eventTTL()))
+	if err != nil {
+		log.Errorf("failed to prune inbox: %v", err)
+		return
+	}
+	log.Debugf("pruned %d processed events from inbox", pruned)
+}
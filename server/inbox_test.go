@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooksHandlerInbox(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateUpdateEventAt(user, "", "Ev01", time.Now())
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+	pending, err := storer.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+
+	// an event which fails to be written stays in the inbox
+	user = util.GenerateRandomUser("U2")
+	body = util.GenerateUpdateEventAt(user, "", "Ev02", time.Now())
+	storer.writeErr = errors.New("db down")
+	w = postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+	pending, err = storer.PendingEvents()
+	a.NoError(err)
+	if a.Len(pending, 1) {
+		a.Equal("Ev02", pending[0].EventID)
+		a.Equal(body, pending[0].Payload)
+	}
+
+	// and is written when it is replayed
+	storer.writeErr = nil
+	replayed, err := app.ReplayEvents(time.Now())
+	a.NoError(err)
+	a.Equal(1, replayed)
+	stored, err := storer.GetUser("U2")
+	a.NoError(err)
+	a.Equal(APIToDBUser(user), stored)
+	pending, err = storer.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+}
+
+func TestWebhooksHandlerInboxUnavailable(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	// slack must retry events we could not save
+	storer.err = errors.New("db down")
+	body := util.GenerateUpdateEvent(util.GenerateRandomUser("U1"), "")
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusServiceUnavailable, w.Code)
+
+	storer.err = nil
+	_, err := storer.GetUser("U1")
+	a.Equal(db.ErrUserNotFound, err)
+}
+
+// TestReplayEventsWritesClaimedEvents checks an event which was recorded as
+// processed but whose user was not written, e.g. from before events were only
+// recorded once written, is written when it is replayed
+func TestReplayEventsWritesClaimedEvents(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateUpdateEventAt(user, "", "Ev01", time.Now())
+	_, err := storer.SaveEvent("Ev01", body)
+	a.NoError(err)
+	ok, err := storer.ClaimEvent("Ev01", time.Now().Add(time.Hour))
+	a.NoError(err)
+	a.True(ok)
+
+	replayed, err := app.ReplayEvents(time.Now())
+	a.NoError(err)
+	a.Equal(1, replayed)
+	stored, err := storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(user), stored)
+	pending, err := storer.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+}
+
+// TestReplayEventsSkipsWrittenEvents checks replaying an event whose user was
+// written before the service stopped records no duplicate history
+func TestReplayEventsSkipsWrittenEvents(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	// the service stopped after writing the user but before completing the
+	// event
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateUpdateEventAt(user, "", "Ev01", time.Now())
+	_, err := storer.SaveEvent("Ev01", body)
+	a.NoError(err)
+	_, err = storer.UpdateUser(APIToDBUser(user), db.Origin{Source: db.SourceWebhook, EventID: "Ev01"})
+	a.NoError(err)
+
+	replayed, err := app.ReplayEvents(time.Now())
+	a.NoError(err)
+	a.Equal(1, replayed)
+	history, err := storer.GetUserHistory("U1")
+	a.NoError(err)
+	a.Len(history, 1)
+	pending, err := storer.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+}
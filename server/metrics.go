@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/cocoonlife/timber"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// outcomes of webhook events, counted by webhookEvents
+const (
+	outcomeUnauthorized = "unauthorized"
+	outcomeMalformed    = "malformed"
+	outcomeIgnored      = "ignored"
+	outcomeAnswered     = "answered"
+	outcomeStoreFailed  = "store_failed"
+	outcomeRejected     = "rejected"
+	outcomeDuplicate    = "duplicate"
+	outcomeWritten      = "written"
+	outcomeUnchanged    = "unchanged"
+	outcomeStale        = "stale"
+	outcomeFailed       = "failed"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	webhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_events_total",
+		Help: "Webhook event deliveries by event type and outcome.",
+	}, []string{"type", "outcome"})
+
+	syncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sync_duration_seconds",
+		Help:    "Duration of fetches and resyncs of users from slack by kind and outcome.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"kind", "outcome"})
+	syncUsersFetched = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sync_users_fetched",
+		Help: "Users returned by slack in the last fetch or resync by kind.",
+	}, []string{"kind"})
+	resyncDrift = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "resync_drift_users_total",
+		Help: "Users reconciled by resyncs because they had drifted from slack by kind of drift.",
+	}, []string{"kind"})
+	usersWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "users_written_total",
+		Help: "Users created or changed in the store by source.",
+	}, []string{"source"})
+
+	usersDesc = prometheus.NewDesc("users",
+		"Users in the store, deleted users are included in the total.", []string{"state"}, nil)
+)
+
+// observeSync records the duration of a fetch or resync of users from slack
+func observeSync(kind string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	syncDuration.WithLabelValues(kind, outcome).Observe(time.Since(start).Seconds())
+}
+
+// observeDrift counts the users a resync reconciled by kind of drift
+func observeDrift(summary SyncSummary) {
+	resyncDrift.WithLabelValues("added").Add(float64(len(summary.Added)))
+	resyncDrift.WithLabelValues("changed").Add(float64(len(summary.Changed)))
+	resyncDrift.WithLabelValues("missing").Add(float64(len(summary.Missing)))
+}
+
+// userCounts collects the number of stored users each time metrics are
+// scraped so they are never out of date, the store is read from the App at
+// scrape time rather than when the collector is registered
+type userCounts struct {
+	app *App
+}
+
+func (c userCounts) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usersDesc
+}
+
+func (c userCounts) Collect(ch chan<- prometheus.Metric) {
+	total, deleted, err := c.app.db.CountUsers()
+	if err != nil {
+		log.Errorf("failed to count users: %v", err)
+		ch <- prometheus.NewInvalidMetric(usersDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(total), "total")
+	ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(deleted), "deleted")
+}
+
+// MetricsHandler serves metrics in the prometheus exposition format
+func (a *App) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(userCounts{app: a})
+	return promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry},
+		promhttp.HandlerOpts{})
+}
+
+// statusRecorder records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument is middleware counting requests and their latency by route, the
+// route is the path template so requests for different users share a label
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := req.URL.Path
+		if current := mux.CurrentRoute(req); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		httpRequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, req.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
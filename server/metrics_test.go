@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer(db.User{ID: "U1"}, db.User{ID: "U2", Deleted: true}, db.User{ID: "U3"})
+	app := newTestApp(t, storer)
+
+	requests := testutil.ToFloat64(httpRequests.WithLabelValues("/api/v1/users/{id}", http.MethodGet, "404"))
+	serve(app, http.MethodGet, "/api/v1/users/U404")
+
+	w := serve(app, http.MethodGet, "/metrics")
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `users{state="total"} 3`)
+	a.Contains(w.Body.String(), `users{state="deleted"} 1`)
+	// requests are labelled by route rather than path
+	a.Equal(requests+1,
+		testutil.ToFloat64(httpRequests.WithLabelValues("/api/v1/users/{id}", http.MethodGet, "404")))
+
+	// a failure to count users fails the scrape rather than reporting zero
+	storer.err = errors.New("db down")
+	w = serve(app, http.MethodGet, "/metrics")
+	a.Equal(http.StatusInternalServerError, w.Code)
+}
+
+// TestMetricsHandlerAfterInit scrapes metrics through the router built by Init
+func TestMetricsHandlerAfterInit(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer(db.User{ID: "U1"})
+	verifier, err := NewVerifier(testSigningSecret, "", DefaultReplayWindow)
+	a.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	app := NewApp()
+	a.NoError(app.Init(ctx, DefaultConfig(), storer, &fakeSlacker{}, verifier))
+	defer func() {
+		cancel()
+		app.background.Wait()
+	}()
+
+	w := httptest.NewRecorder()
+	app.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	a.Equal(http.StatusOK, w.Code)
+	a.Contains(w.Body.String(), `users{state="total"} 1`)
+}
+
+func TestWebhookEventMetrics(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	counts := func() []float64 {
+		return []float64{
+			testutil.ToFloat64(webhookEvents.WithLabelValues("user_change", outcomeWritten)),
+			testutil.ToFloat64(webhookEvents.WithLabelValues("user_change", outcomeDuplicate)),
+			testutil.ToFloat64(webhookEvents.WithLabelValues("unknown", outcomeUnauthorized)),
+			testutil.ToFloat64(webhookEvents.WithLabelValues("user_change", outcomeFailed)),
+		}
+	}
+	before := counts()
+
+	body := util.GenerateUpdateEventAt(util.GenerateRandomUser("U1"), "", "Ev01", time.Now())
+	postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	postWebhook(app, http.Header{}, body)
+	storer.writeErr = errors.New("db down")
+	body = util.GenerateUpdateEventAt(util.GenerateRandomUser("U2"), "", "Ev02", time.Now())
+	postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+
+	after := counts()
+	for i := range before {
+		a.Equal(before[i]+1, after[i], "count %d", i)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	log "github.com/cocoonlife/timber"
+	"github.com/slack-go/slack"
+)
+
+const (
+	// DefaultQueueSize is how many webhook events can wait to be written
+	// before deliveries are refused
+	DefaultQueueSize = 1000
+	// DefaultQueueWorkers is how many webhook events are written concurrently
+	DefaultQueueWorkers = 4
+)
+
+var (
+	// ErrQueueFull is returned when enqueueing to a full queue, slack is asked
+	// to retry the delivery later
+	ErrQueueFull = errors.New("webhook queue is full")
+	// ErrQueueClosed is returned when enqueueing to a queue which is draining
+	// for shutdown
+	ErrQueueClosed = errors.New("webhook queue is closed")
+)
+
+// userEvent is a user received in a webhook event, waiting to be written
+type userEvent struct {
+	user   slack.User
+	origin db.Origin
+	// eventType is the type of the event the user was received in
+	eventType string
+	// inboxID is the id the event was saved to the inbox with
+	inboxID int64
+}
+
+// webhookQueue is a bounded queue of events drained by a pool of workers
+type webhookQueue struct {
+	events  chan userEvent
+	process func(userEvent)
+	// pending counts events which are queued or being processed
+	pending sync.WaitGroup
+
+	// mu guards closed so events are never sent on a closed channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newWebhookQueue starts workers which call process for each queued event
+func newWebhookQueue(size, workers int, process func(userEvent)) *webhookQueue {
+	q := &webhookQueue{events: make(chan userEvent, size), process: process}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *webhookQueue) work() {
+	for ev := range q.events {
+		q.process(ev)
+		q.pending.Done()
+	}
+}
+
+// enqueue adds an event to the queue without blocking, it returns
+// ErrQueueFull if there is no room
+func (q *webhookQueue) enqueue(ev userEvent) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.pending.Add(1)
+	select {
+	case q.events <- ev:
+		return nil
+	default:
+		q.pending.Done()
+		return ErrQueueFull
+	}
+}
+
+// wait blocks until every queued event has been processed
+func (q *webhookQueue) wait() {
+	q.pending.Wait()
+}
+
+// close stops the queue accepting events and waits for those already queued
+// to be processed, or for ctx to be done
+func (q *webhookQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		log.Errorf("gave up draining webhook queue: %v", ctx.Err())
+		return ctx.Err()
+	}
+}
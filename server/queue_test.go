@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookQueue(t *testing.T) {
+	a := assert.New(t)
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var processed []string
+	q := newWebhookQueue(1, 1, func(ev userEvent) {
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		processed = append(processed, ev.origin.EventID)
+		mu.Unlock()
+	})
+	event := func(eventID string) userEvent {
+		return userEvent{origin: db.Origin{Source: db.SourceWebhook, EventID: eventID}}
+	}
+
+	// the worker holds the first event and the queue the second
+	a.NoError(q.enqueue(event("Ev01")))
+	<-started
+	a.NoError(q.enqueue(event("Ev02")))
+	a.Equal(ErrQueueFull, q.enqueue(event("Ev03")))
+
+	// closing gives up once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	a.Equal(context.DeadlineExceeded, q.close(ctx))
+	a.Equal(ErrQueueClosed, q.enqueue(event("Ev04")))
+
+	// events queued before closing are still processed
+	close(release)
+	a.NoError(q.close(context.Background()))
+	a.Equal([]string{"Ev01", "Ev02"}, processed)
+}
+
+func TestWebhooksHandlerQueueFull(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+	// a queue without room or workers is always full
+	app.queue = newWebhookQueue(0, 0, app.processUserEvent)
+
+	body := util.GenerateUpdateEvent(util.GenerateRandomUser("U1"), "")
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusServiceUnavailable, w.Code)
+	_, err := storer.GetUser("U1")
+	a.Equal(db.ErrUserNotFound, err)
+	// the rejected event is left to slack's retry rather than replayed
+	pending, err := storer.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+	replayed, err := app.ReplayEvents(time.Now())
+	a.NoError(err)
+	a.Equal(0, replayed)
+}
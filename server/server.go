@@ -1,15 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
-	"math/rand"
 	"net/http"
 	"reflect"
-	"text/template"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/aultimus/slack-user-data-service/backoff"
 	"github.com/aultimus/slack-user-data-service/db"
 	log "github.com/cocoonlife/timber"
 	"github.com/davecgh/go-spew/spew"
@@ -22,86 +26,275 @@ const (
 	ContentType    = "Content-Type"
 	DefaultPortNum = "3000"
 	MimeTypeJSON   = "application/json"
+	MimeTypeText   = "text/plain"
 )
 
+// DefaultShutdownTimeout is how long Shutdown is given to drain requests and
+// queued events by default
+const DefaultShutdownTimeout = 20 * time.Second
+
 func NewApp() *App {
 	return &App{}
 }
 
 type Storer interface {
-	CreateUsers(user []db.User) error
-	UpdateUser(user db.User) error
-	GetAllUsers() ([]db.User, error)
+	// CreateUsers upserts users and returns how many were created or changed,
+	// users whose data is unchanged are not written. If a user appears more
+	// than once only its last entry is written
+	CreateUsers(user []db.User, origin db.Origin) (int, error)
+	// UpdateUser upserts a user and reports whether it was created or changed
+	UpdateUser(user db.User, origin db.Origin) (bool, error)
+	GetUsersPage(cursor string, limit int) (db.Page, error)
+	GetUser(id string) (db.User, error)
+	GetUserHistory(id string) ([]db.UserChange, error)
+	// CountUsers returns how many users are stored and how many of those are
+	// deleted
+	CountUsers() (total int, deleted int, err error)
+	// Ping checks that the store is reachable
+	Ping(ctx context.Context) error
+	// ClaimEvent records that a webhook event has been processed until
+	// expires, it reports false if the event already had been
+	ClaimEvent(eventID string, expires time.Time) (bool, error)
+	// SaveEvent saves a raw webhook payload to the inbox and returns its id
+	SaveEvent(eventID string, payload []byte) (int64, error)
+	// CompleteEvent marks an inbox event as processed
+	CompleteEvent(id int64) error
+	// PendingEvents returns unprocessed inbox events, oldest first
+	PendingEvents() ([]db.InboxEvent, error)
+	// PruneEvents deletes inbox events processed before the given time
+	PruneEvents(before time.Time) (int, error)
 }
 
-// TODO: use Slacker interface to enable dependency injection and unit testing
-//type Slacker interface {
-//	GetUsersContext(ctx context.Context) ([]slack.User, error)
-//}
-
-type App struct {
-	server            *http.Server
-	db                Storer
-	slackClient       *slack.Client
-	verificationToken string
+// Slacker is the subset of the slack api used by App, NewSlacker adapts
+// *slack.Client to it and it allows the api to be faked in tests
+type Slacker interface {
+	// GetUsersPage returns a page of users and the cursor of the next page,
+	// pass an empty cursor for the first page. The next cursor is empty after
+	// the last page
+	GetUsersPage(ctx context.Context, cursor string) (users []slack.User, nextCursor string, err error)
 }
 
-// Init initialises the application server, call before Run
-func (a *App) Init(portNum string, storer Storer, slackClient *slack.Client,
-	verificationToken string) error {
-	log.Infof("init")
-	router := mux.NewRouter()
+type App struct {
+	// webhooks and lastSync are first so they are aligned for atomic access
+	// on 32 bit platforms
+	webhooks webhookCounters
+	// lastSync is when users were last successfully synced with slack in unix
+	// nanoseconds, 0 if they never have been
+	lastSync int64
 
-	server := &http.Server{
-		Addr:         ":" + portNum,
-		Handler:      router,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
-	}
+	server      *http.Server
+	db          Storer
+	slackClient Slacker
+	verifier    *Verifier
+	// dedupTTL is how long processed webhook events are remembered
+	dedupTTL time.Duration
+	// fetchTimeout and resyncTimeout bound calls to slack, defaults are used
+	// when they are zero
+	fetchTimeout  time.Duration
+	resyncTimeout time.Duration
+	// syncInterval is how often users are resynced, and maxSyncAge how long
+	// since the last successful sync we are ready for, 0 is three intervals
+	syncInterval time.Duration
+	maxSyncAge   time.Duration
+	// queue holds webhook events waiting to be written
+	queue *webhookQueue
+	// background tracks the fetch and sync loops started by Init
+	background sync.WaitGroup
 
-	router.HandleFunc("/health", a.HealthHandler)
-	router.HandleFunc("/users", a.UsersHandler).Methods(http.MethodGet)
-	router.HandleFunc("/webhooks", a.WebhooksHandler).Methods(http.MethodPost)
+	// fetchBackoff is how FetchUsersLoop retries, slackBreaker guards calls to
+	// the slack api and clock is faked in tests, nil is the wall clock
+	fetchBackoff backoff.Policy
+	slackBreaker *backoff.Breaker
+	clock        backoff.Clock
+}
 
-	a.server = server
+// Init initialises the application server, call before Run. Background work
+// such as syncing users from slack stops when ctx is done
+func (a *App) Init(ctx context.Context, cfg Config, storer Storer, slackClient Slacker,
+	verifier *Verifier) error {
+	log.Infof("init")
 	a.db = storer
-	a.verificationToken = verificationToken
+	a.verifier = verifier
 	a.slackClient = slackClient
+	a.dedupTTL = cfg.Webhooks.DedupTTL
+	a.fetchTimeout = cfg.Sync.FetchTimeout
+	a.resyncTimeout = cfg.Sync.ResyncTimeout
+	a.syncInterval = cfg.Sync.Interval
+	a.maxSyncAge = cfg.Sync.MaxAge
+	a.fetchBackoff = cfg.Slack.retryPolicy()
+	a.slackBreaker = backoff.NewBreaker(cfg.Slack.BreakerThreshold, cfg.Slack.BreakerCooldown, a.clock)
+	a.queue = newWebhookQueue(cfg.Webhooks.QueueSize, cfg.Webhooks.QueueWorkers, a.processUserEvent)
+
+	// the router's handlers use the dependencies above so it is built last
+	a.server = &http.Server{
+		Addr:         ":" + cfg.Port,
+		Handler:      a.newRouter(),
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+	}
 
 	// run asynchronously so we can still serve requests if api is down
-	go a.FetchUsersLoop()
+	a.background.Add(1)
+	go func() {
+		defer a.background.Done()
+		a.replayInbox(time.Now())
+		a.FetchUsersLoop(ctx)
+		a.SyncLoop(ctx, cfg.Sync.Interval)
+	}()
 
 	return nil
 }
 
-// TODO: do something with long running requests and use context
+func (a *App) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(instrument)
+	router.Handle("/metrics", a.MetricsHandler()).Methods(http.MethodGet)
+	router.HandleFunc("/health", a.HealthHandler)
+	router.HandleFunc("/healthz", a.HealthHandler)
+	router.HandleFunc("/readyz", a.ReadyHandler)
+	router.HandleFunc("/users", a.UsersHandler).Methods(http.MethodGet)
+	router.HandleFunc("/users/{id}/history", a.UserHistoryHandler).Methods(http.MethodGet)
+	router.HandleFunc("/webhooks", a.WebhooksHandler).Methods(http.MethodPost)
 
-// Run starts the application server, call Init first
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/users", a.APIUsersHandler).Methods(http.MethodGet)
+	api.HandleFunc("/users/{id}", a.APIUserHandler).Methods(http.MethodGet)
+	api.HandleFunc("/users/{id}/history", a.APIUserHistoryHandler).Methods(http.MethodGet)
+	api.HandleFunc("/webhooks/stats", a.APIWebhookStatsHandler).Methods(http.MethodGet)
+	return router
+}
+
+// Run starts the application server, call Init first. It blocks until the
+// server fails or Shutdown is called, in which case it returns nil
 func (a *App) Run() error {
 	log.Infof("running server on %s", a.server.Addr)
-	return a.server.ListenAndServe()
+	err := a.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
-func (a *App) HealthHandler(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(200)
+// Shutdown stops the server accepting requests and waits for in flight
+// requests, queued webhook events and the background loops to complete, or
+// for ctx to be done. Cancel the context passed to Init first so that the
+// background loops stop
+func (a *App) Shutdown(ctx context.Context) error {
+	err := a.server.Shutdown(ctx)
+	if queueErr := a.queue.close(ctx); err == nil {
+		err = queueErr
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Errorf("timed out waiting for background loops to stop")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
 }
 
-// UsersHandler on request renders a html table of users stored by this service
+// UsersHandler on request renders a html table of a page of users stored by
+// this service
 func (a *App) UsersHandler(w http.ResponseWriter, req *http.Request) {
-	users, err := a.db.GetAllUsers()
+	cursor, limit, err := pageParams(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
+	page, err := a.db.GetUsersPage(cursor, limit)
+	if errors.Is(err, db.ErrInvalidCursor) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Bad Request"))
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("500 - Internal Server Error"))
-		log.Errorf("db GetAllUsers returned error: %v", err)
+		log.Errorf("db GetUsersPage returned error: %v", err)
 		return
 	}
 	usersStruct := struct {
-		Users []db.User
-	}{Users: users}
+		Users      []db.User
+		NextCursor string
+		PrevCursor string
+		Limit      int
+	}{Users: page.Users, NextCursor: page.NextCursor, PrevCursor: page.PrevCursor,
+		Limit: db.ClampPageSize(limit)}
+
+	renderTemplate(w, "users.html", usersStruct)
+}
+
+// UserHistoryHandler on request renders a html view of the recorded changes
+// to a user
+func (a *App) UserHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	history, err := a.db.GetUserHistory(id)
+	if errors.Is(err, db.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - Not Found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Internal Server Error"))
+		log.Errorf("db GetUserHistory returned error: %v, id: %s", err, id)
+		return
+	}
+	historyStruct := struct {
+		ID      string
+		History []db.UserChange
+	}{ID: id, History: history}
+
+	renderTemplate(w, "history.html", historyStruct)
+}
+
+// templateDir is where the html templates are read from
+var templateDir = "./html"
 
-	tmpl, _ := template.ParseFiles("./html/users.html")
-	tmpl.Execute(w, usersStruct)
+// renderTemplate executes the named html template with data, the page is
+// rendered before anything is written so that a failure can be reported as a
+// 500 rather than a truncated page
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	tmpl, err := template.ParseFiles(templateDir + "/" + name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Internal Server Error"))
+		log.Errorf("failed to parse template %s: %v", name, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Internal Server Error"))
+		log.Errorf("failed to execute template %s: %v", name, err)
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// pageParams reads the optional cursor and limit query parameters used to
+// paginate user listings, a missing limit is returned as 0
+func pageParams(req *http.Request) (string, int, error) {
+	query := req.URL.Query()
+	var limit int
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return "", 0, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	return query.Get("cursor"), limit, nil
 }
 
 // WebhooksHandler processes events from the slack events api
@@ -109,54 +302,160 @@ func (a *App) UsersHandler(w http.ResponseWriter, req *http.Request) {
 func (a *App) WebhooksHandler(w http.ResponseWriter, req *http.Request) {
 	b, err := io.ReadAll(req.Body)
 	if err != nil {
-		log.Errorf("failed to parse slack event body: %v", err)
+		log.Errorf("failed to read slack event body: %v", err)
+		writeJSONError(w, http.StatusBadRequest, "failed to read request body")
 		return
 	}
 	defer req.Body.Close()
 
 	log.Debug(string(b))
 
-	event, err := slackevents.ParseEvent(b, slackevents.OptionVerifyToken(
-		&slackevents.TokenComparator{a.verificationToken}))
+	err = a.verifier.Verify(req.Header, b)
+	if err != nil {
+		log.Errorf("failed to verify slack request: %v", err)
+		webhookEvents.WithLabelValues("unknown", outcomeUnauthorized).Inc()
+		writeJSONError(w, http.StatusUnauthorized, "request verification failed")
+		return
+	}
+
+	// the request has already been verified above
+	event, err := slackevents.ParseEvent(b, slackevents.OptionNoVerifyToken())
 	if err != nil {
 		log.Errorf("failed slackevents.ParseEvent: %v", err)
+		webhookEvents.WithLabelValues("unknown", outcomeMalformed).Inc()
+		writeJSONError(w, http.StatusBadRequest, "malformed event payload")
+		return
+	}
+	// slack sends a challenge when the events api request url is configured
+	// https://api.slack.com/events/url_verification
+	if event.Type == slackevents.URLVerification {
+		verificationEvent, ok := event.Data.(*slackevents.EventsAPIURLVerificationEvent)
+		if !ok {
+			log.Errorf("url_verification event has data of type %v ", reflect.TypeOf(event.Data))
+			webhookEvents.WithLabelValues(event.Type, outcomeMalformed).Inc()
+			writeJSONError(w, http.StatusBadRequest, "malformed url_verification event")
+			return
+		}
+		log.Infof("responding to url_verification challenge")
+		webhookEvents.WithLabelValues(event.Type, outcomeAnswered).Inc()
+		w.Header().Set(ContentType, MimeTypeText)
+		w.Write([]byte(verificationEvent.Challenge))
+		return
+	}
+
+	ev, ok, err := userEventFromCallback(event)
+	a.countDelivery(req, ev.origin.EventID)
+	if err != nil {
+		log.Errorf("failed to read user from event %s: %v", ev.origin.EventID, err)
+		webhookEvents.WithLabelValues(ev.eventType, outcomeMalformed).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	log.Debugf("received %s type event", event.InnerEvent.Type)
+	if !ok {
+		webhookEvents.WithLabelValues(ev.eventType, outcomeIgnored).Inc()
+		return
+	}
+
+	// save the event before acknowledging it so it is not lost if we stop
+	// before it is processed, slack retries the event on a 5xx
+	ev.inboxID, err = a.db.SaveEvent(ev.origin.EventID, b)
+	if err != nil {
+		log.Errorf("failed to save event %s to inbox: %v", ev.origin.EventID, err)
+		webhookEvents.WithLabelValues(ev.eventType, outcomeStoreFailed).Inc()
+		writeJSONError(w, http.StatusServiceUnavailable, "failed to store event")
+		return
+	}
+
+	// users are written by the queue's workers so that slack is acknowledged
+	// within its three second timeout however slow the database is
+	err = a.queue.enqueue(ev)
+	if err != nil {
+		log.Errorf("failed to queue event %s: %v", ev.origin.EventID, err)
+		webhookEvents.WithLabelValues(ev.eventType, outcomeRejected).Inc()
+		// slack retries the event, saving it to the inbox again, so this copy
+		// is not left behind to be replayed
+		a.completeEvent(ev.inboxID)
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+}
+
+// userEventFromCallback returns the user carried by an events api callback,
+// ok is false for events which do not carry a user and err is set for user
+// events which are malformed
+func userEventFromCallback(event slackevents.EventsAPIEvent) (ev userEvent, ok bool, err error) {
+	ev.origin = db.Origin{Source: db.SourceWebhook}
+	ev.eventType = event.InnerEvent.Type
+	if callbackEvent, ok := event.Data.(*slackevents.EventsAPICallbackEvent); ok {
+		ev.origin.EventID = callbackEvent.EventID
+		ev.origin.EventTime = int64(callbackEvent.EventTime)
+	}
+
+	log.Debugf("received %s type event %s", event.InnerEvent.Type, ev.origin.EventID)
 	switch event.InnerEvent.Type {
-	// Note: go falls through by default
-	// It is possible that we also want to process team_join events here but i
-	// have always seem team_join and user_change events co-occur so this may
-	// be somewhat redundant
 	case "user_change":
 		// https://api.slack.com/events/user_change
 		log.Debugf("processing %s event", event.InnerEvent.Type)
 		userChangeEvent, ok := event.InnerEvent.Data.(*slack.UserChangeEvent)
 		if !ok {
-			log.Errorf("user_change event has inner data of type %v ", reflect.TypeOf(event.InnerEvent.Data))
-			return
+			return ev, false, fmt.Errorf("user_change event has inner data of type %v",
+				reflect.TypeOf(event.InnerEvent.Data))
 		}
-		apiUser := userChangeEvent.User
-		dbUser := APIToDBUser(apiUser)
-		err = a.db.UpdateUser(dbUser)
-		if err != nil {
-			log.Errorf("error during UpdateUser: %s, user: %s", err.Error(), spew.Sdump(dbUser))
-			return
+		ev.user = userChangeEvent.User
+
+	case "team_join":
+		// https://api.slack.com/events/team_join
+		// user_change events usually accompany team_join events but not always,
+		// so persist new users as soon as they join
+		log.Debugf("processing %s event", event.InnerEvent.Type)
+		teamJoinEvent, ok := event.InnerEvent.Data.(*slackevents.TeamJoinEvent)
+		if !ok || teamJoinEvent.User == nil {
+			return ev, false, errors.New("team_join event has no user")
 		}
-		log.Debugf("updated user %s", dbUser.ID)
+		ev.user = *teamJoinEvent.User
 
 	default: // unrecognised event type
-		// should we also respond to url_verification events? Seems important when
-		// setting up service but maybe unneccesary now webhooks endpoint is setup
-		// https://api.slack.com/events/url_verification
 		log.Debugf("ignoring event of event type %s", event.InnerEvent.Type)
+		return ev, false, nil
+	}
+	return ev, true, nil
+}
+
+// updateUser upserts the user received in an event and returns the outcome
+func (a *App) updateUser(ev userEvent) (string, error) {
+	dbUser := APIToDBUser(ev.user)
+	origin := ev.origin
+	changed, err := a.db.UpdateUser(dbUser, origin)
+	if errors.Is(err, db.ErrStaleUser) {
+		// slack retries and resyncs can deliver users out of order
+		log.Infof("ignoring stale user %s from event %s", dbUser.ID, origin.EventID)
+		return outcomeStale, nil
+	}
+	if err != nil {
+		log.Errorf("error during UpdateUser: %s, user: %s", err.Error(), spew.Sdump(dbUser))
+		return outcomeFailed, err
+	}
+	if !changed {
+		// slack sends user_change for changes to data we do not store
+		log.Debugf("user %s unchanged by event %s", dbUser.ID, origin.EventID)
+		return outcomeUnchanged, nil
 	}
+	log.Infof("updated user %s from event %s", dbUser.ID, origin.EventID)
+	usersWritten.WithLabelValues(string(origin.Source)).Inc()
+	return outcomeWritten, nil
 }
 
 func APIToDBUser(in slack.User) db.User {
 	// we could either implement this function via marshalling and unmarshalling
 	// or via mapping. marshalling and unmarshalling is more extensible
 	// but less can go wrong with a mapping function like this
+	var fields db.ProfileFields
+	if customFields := in.Profile.FieldsMap(); len(customFields) > 0 {
+		fields = make(db.ProfileFields, len(customFields))
+		for id, f := range customFields {
+			fields[id] = db.ProfileField{Value: f.Value, Alt: f.Alt, Label: f.Label}
+		}
+	}
 	return db.User{
 		Deleted:            in.Deleted,
 		ID:                 in.ID,
@@ -166,9 +465,99 @@ func APIToDBUser(in slack.User) db.User {
 		ProfileStatusText:  in.Profile.StatusText,
 		RealName:           in.RealName,
 		TZ:                 in.TZ,
+
+		TeamID:            in.TeamID,
+		TZLabel:           in.TZLabel,
+		TZOffset:          in.TZOffset,
+		IsAdmin:           in.IsAdmin,
+		IsOwner:           in.IsOwner,
+		IsPrimaryOwner:    in.IsPrimaryOwner,
+		IsRestricted:      in.IsRestricted,
+		IsUltraRestricted: in.IsUltraRestricted,
+		IsBot:             in.IsBot,
+		IsAppUser:         in.IsAppUser,
+		Updated:           int64(in.Updated),
+
+		ProfileFirstName:             in.Profile.FirstName,
+		ProfileLastName:              in.Profile.LastName,
+		ProfileRealNameNormalized:    in.Profile.RealNameNormalized,
+		ProfileDisplayName:           in.Profile.DisplayName,
+		ProfileDisplayNameNormalized: in.Profile.DisplayNameNormalized,
+		ProfileEmail:                 in.Profile.Email,
+		ProfileSkype:                 in.Profile.Skype,
+		ProfilePhone:                 in.Profile.Phone,
+		ProfileTitle:                 in.Profile.Title,
+		ProfileImage24:               in.Profile.Image24,
+		ProfileImage32:               in.Profile.Image32,
+		ProfileImage48:               in.Profile.Image48,
+		ProfileImage72:               in.Profile.Image72,
+		ProfileImage192:              in.Profile.Image192,
+		ProfileImageOriginal:         in.Profile.ImageOriginal,
+		ProfileStatusExpiration:      in.Profile.StatusExpiration,
+		ProfileBotID:                 in.Profile.BotID,
+		ProfileAPIAppID:              in.Profile.ApiAppID,
+		ProfileTeam:                  in.Profile.Team,
+		ProfileFields:                fields,
 	}
 }
 
+// DBToAPIUser is the inverse of APIToDBUser, slack fields which we do not
+// store are left empty
+func DBToAPIUser(in db.User) slack.User {
+	out := slack.User{
+		Deleted:  in.Deleted,
+		ID:       in.ID,
+		Name:     in.Name,
+		RealName: in.RealName,
+		TZ:       in.TZ,
+
+		TeamID:            in.TeamID,
+		TZLabel:           in.TZLabel,
+		TZOffset:          in.TZOffset,
+		IsAdmin:           in.IsAdmin,
+		IsOwner:           in.IsOwner,
+		IsPrimaryOwner:    in.IsPrimaryOwner,
+		IsRestricted:      in.IsRestricted,
+		IsUltraRestricted: in.IsUltraRestricted,
+		IsBot:             in.IsBot,
+		IsAppUser:         in.IsAppUser,
+		Updated:           slack.JSONTime(in.Updated),
+
+		Profile: slack.UserProfile{
+			Image512:              in.ProfileImage512,
+			StatusEmoji:           in.ProfileStatusEmoji,
+			StatusText:            in.ProfileStatusText,
+			FirstName:             in.ProfileFirstName,
+			LastName:              in.ProfileLastName,
+			RealNameNormalized:    in.ProfileRealNameNormalized,
+			DisplayName:           in.ProfileDisplayName,
+			DisplayNameNormalized: in.ProfileDisplayNameNormalized,
+			Email:                 in.ProfileEmail,
+			Skype:                 in.ProfileSkype,
+			Phone:                 in.ProfilePhone,
+			Title:                 in.ProfileTitle,
+			Image24:               in.ProfileImage24,
+			Image32:               in.ProfileImage32,
+			Image48:               in.ProfileImage48,
+			Image72:               in.ProfileImage72,
+			Image192:              in.ProfileImage192,
+			ImageOriginal:         in.ProfileImageOriginal,
+			StatusExpiration:      in.ProfileStatusExpiration,
+			BotID:                 in.ProfileBotID,
+			ApiAppID:              in.ProfileAPIAppID,
+			Team:                  in.ProfileTeam,
+		},
+	}
+	if len(in.ProfileFields) > 0 {
+		fields := make(map[string]slack.UserProfileCustomField, len(in.ProfileFields))
+		for id, f := range in.ProfileFields {
+			fields[id] = slack.UserProfileCustomField{Value: f.Value, Alt: f.Alt, Label: f.Label}
+		}
+		out.Profile.SetFieldsMap(fields)
+	}
+	return out
+}
+
 func APIToDBUsers(in []slack.User) []db.User {
 	out := make([]db.User, len(in))
 	for i := 0; i < len(in); i++ {
@@ -178,41 +567,41 @@ func APIToDBUsers(in []slack.User) []db.User {
 }
 
 // fetchUsersLoop initialises the database with users fetched from the slack api
-// and keeps retrying upon errors, call this in a goroutine so it does not block
-func (a *App) FetchUsersLoop() {
-	for {
-		// TODO: make this timeout configurable
-		ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
-		err := a.FetchUsers(ctx)
-		if err == nil {
-			cancelFunc()
-			return
+// and keeps retrying upon errors until ctx is done, call this in a goroutine so
+// it does not block
+func (a *App) FetchUsersLoop(ctx context.Context) {
+	err := a.fetchBackoff.Retry(ctx, a.clock, func(ctx context.Context) error {
+		fetchCtx, cancelFunc := context.WithTimeout(ctx, durationOrDefault(a.fetchTimeout, DefaultFetchTimeout))
+		defer cancelFunc()
+		err := a.FetchUsers(fetchCtx)
+		if err != nil {
+			log.Errorf(err.Error())
 		}
-		cancelFunc()
-		log.Errorf(err.Error())
-		// it would be nicer to have more sophisticated backoff strategy e.g.
-		// exponential backoff with randomness but we really only need that if
-		// we have lots of clients developing into a thundering herd
-		// TODO: make this duration configurable
-		time.Sleep(time.Second + time.Duration(rand.Intn(1000))*time.Millisecond)
+		return err
+	})
+	if err != nil {
+		log.Errorf("stopped fetching users: %v", err)
 	}
 }
 
 // FetchUsers retrieves the initial set of users used to initialise the database
-func (a *App) FetchUsers(ctx context.Context) error {
-	// GetUsersContext performs paginated requests
-	users, err := a.slackClient.GetUsersContext(ctx)
+func (a *App) FetchUsers(ctx context.Context) (err error) {
+	defer func(start time.Time) { observeSync("fetch", start, err) }(time.Now())
+	users, err := a.getUsers(ctx)
 	if err != nil {
-		return fmt.Errorf("failed api call to slack GetUsers: %v", err)
+		return fmt.Errorf("failed api call to slack GetUsers: %w", err)
 	}
 	log.Infof("retrieved %d users from GetUsers API", len(users))
+	syncUsersFetched.WithLabelValues("fetch").Set(float64(len(users)))
 
 	dbUsers := APIToDBUsers(users)
-	err = a.db.CreateUsers(dbUsers)
+	written, err := a.db.CreateUsers(dbUsers, db.Origin{Source: db.SourceInitialSync})
 	if err != nil {
 		return fmt.Errorf("failed db CreateUsers call: %v", err)
 	}
-	// TODO: more detailed log message
-	log.Infof("wrote %d users to DB", len(dbUsers))
+	usersWritten.WithLabelValues(string(db.SourceInitialSync)).Add(float64(written))
+	a.syncSucceeded()
+	log.Infof("wrote %d new or changed users to DB, %d were unchanged or stale",
+		written, len(dbUsers)-written)
 	return nil
 }
@@ -1,10 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"net/http"
+	"net/http/httptest"
+	"sort"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/aultimus/slack-user-data-service/backoff"
+	"github.com/aultimus/slack-user-data-service/backoff/backofftest"
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
 	"github.com/stretchr/testify/assert"
@@ -56,3 +69,504 @@ func TestParseEvent(t *testing.T) {
 	a.True(ok)
 	a.Equal("Matthew Ault", userChangeEvent.User.RealName)
 }
+
+func postWebhook(a *App, header http.Header, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	a.newRouter().ServeHTTP(w, req)
+	// wait for the event to be written so tests can check the store
+	a.queue.wait()
+	return w
+}
+
+func newTestApp(t *testing.T, storer Storer) *App {
+	verifier, err := NewVerifier(testSigningSecret, "", DefaultReplayWindow)
+	assert.NoError(t, err)
+	app := &App{db: storer, verifier: verifier}
+	app.queue = newWebhookQueue(DefaultQueueSize, DefaultQueueWorkers, app.processUserEvent)
+	t.Cleanup(func() { app.queue.close(context.Background()) })
+	return app
+}
+
+func TestWebhooksHandlerVerification(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateUpdateEvent(user, "")
+
+	w := postWebhook(app, signedHeader("wrong", time.Now(), body), body)
+	a.Equal(http.StatusUnauthorized, w.Code)
+	w = postWebhook(app, http.Header{}, body)
+	a.Equal(http.StatusUnauthorized, w.Code)
+	_, err := storer.GetUser("U1")
+	a.Equal(db.ErrUserNotFound, err)
+
+	w = postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+	stored, err := storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(user), stored)
+}
+
+func TestWebhooksHandlerURLVerification(t *testing.T) {
+	a := assert.New(t)
+	app := newTestApp(t, newFakeStorer())
+
+	body := util.GenerateURLVerificationEvent("3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P", "")
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P", w.Body.String())
+
+	// the challenge must not be answered for unverified requests
+	w = postWebhook(app, signedHeader("wrong", time.Now(), body), body)
+	a.Equal(http.StatusUnauthorized, w.Code)
+	a.NotContains(w.Body.String(), "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P")
+}
+
+func TestWebhooksHandlerErrors(t *testing.T) {
+	user := util.GenerateRandomUser("U1")
+	userChange := util.GenerateUpdateEvent(user, "")
+	teamJoinWithoutUser := []byte(`{"type": "event_callback", "event_id": "Ev01", "event": {"type": "team_join"}}`)
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		body       []byte
+		storerErr  error
+		wantStatus int
+	}{
+		{"unsigned", http.Header{}, userChange, nil, http.StatusUnauthorized},
+		{"wrong secret", signedHeader("wrong", time.Now(), userChange), userChange, nil, http.StatusUnauthorized},
+		{"stale signature", signedHeader(testSigningSecret, time.Now().Add(-time.Hour), userChange), userChange,
+			nil, http.StatusUnauthorized},
+		{"not json", nil, []byte("not json"), nil, http.StatusBadRequest},
+		{"malformed user", nil, []byte(`{"type": "event_callback", "event": {"type": "user_change", "user": "U1"}}`),
+			nil, http.StatusBadRequest},
+		{"team_join without user", nil, teamJoinWithoutUser, nil, http.StatusBadRequest},
+		{"storage failure", nil, userChange, errors.New("db down"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			a := assert.New(t)
+			storer := newFakeStorer()
+			storer.err = tt.storerErr
+			app := newTestApp(t, storer)
+
+			header := tt.header
+			if header == nil {
+				header = signedHeader(testSigningSecret, time.Now(), tt.body)
+			}
+			w := postWebhook(app, header, tt.body)
+			a.Equal(tt.wantStatus, w.Code)
+			a.Equal(MimeTypeJSON, w.Header().Get(ContentType))
+			var resp ErrorResponse
+			a.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+			a.Equal(tt.wantStatus, resp.Status)
+			a.NotEmpty(resp.Message)
+
+			storer.err = nil
+			_, err := storer.GetUser("U1")
+			a.Equal(db.ErrUserNotFound, err)
+		})
+	}
+}
+
+func TestWebhooksHandlerUnreadableBody(t *testing.T) {
+	a := assert.New(t)
+	app := newTestApp(t, newFakeStorer())
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", iotest.ErrReader(errors.New("connection reset")))
+	app.WebhooksHandler(w, req)
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.JSONEq(`{"status": 400, "message": "failed to read request body"}`, w.Body.String())
+}
+
+func TestWebhooksHandlerTeamJoin(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+
+	user := util.GenerateRandomUser("U1")
+	body := util.GenerateTeamJoinEvent(user, "")
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+
+	stored, err := storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(user), stored)
+}
+
+// TestWebhooksHandlerReorderedEvents delivers events out of order, as retries
+// can, and checks older data never overwrites newer data
+func TestWebhooksHandlerReorderedEvents(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+	deliver := func(user slack.User, eventID string, eventTime time.Time) {
+		body := util.GenerateUpdateEventAt(user, "", eventID, eventTime)
+		w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+		a.Equal(http.StatusOK, w.Code)
+	}
+	now := time.Now()
+
+	first := util.GenerateRandomUser("U1")
+	first.Updated = slack.JSONTime(now.Unix())
+	second := first
+	second.Profile.StatusText = "second"
+	second.Updated = first.Updated + 1
+	// the newer revision arrives first
+	deliver(second, "Ev02", now.Add(time.Second))
+	deliver(first, "Ev01", now)
+	stored, err := storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(second), stored)
+
+	// events for the same revision are ordered by event time
+	third := second
+	third.Profile.StatusText = "third"
+	deliver(third, "Ev03", now)
+	stored, err = storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(second), stored)
+	deliver(third, "Ev04", now.Add(2*time.Second))
+	stored, err = storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(third), stored)
+
+	history, err := storer.GetUserHistory("U1")
+	a.NoError(err)
+	if a.Len(history, 2) {
+		a.Equal("Ev04", history[0].EventID)
+		a.Equal("Ev02", history[1].EventID)
+	}
+}
+
+// TestWebhooksHandlerStaleEvent checks an older event delivered after a newer
+// one is acknowledged, counted as stale and does not overwrite the user
+func TestWebhooksHandlerStaleEvent(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	app := newTestApp(t, storer)
+	now := time.Now()
+
+	older := util.GenerateRandomUser("U1")
+	older.Updated = slack.JSONTime(now.Unix())
+	newer := older
+	newer.Profile.StatusText = "newer"
+	newer.Updated = older.Updated + 1
+	stale := testutil.ToFloat64(webhookEvents.WithLabelValues("user_change", outcomeStale))
+
+	body := util.GenerateUpdateEventAt(newer, "", "Ev02", now.Add(time.Second))
+	w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+	body = util.GenerateUpdateEventAt(older, "", "Ev01", now)
+	w = postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+	a.Equal(http.StatusOK, w.Code)
+
+	a.Equal(stale+1, testutil.ToFloat64(webhookEvents.WithLabelValues("user_change", outcomeStale)))
+	stored, err := storer.GetUser("U1")
+	a.NoError(err)
+	a.Equal(APIToDBUser(newer), stored)
+	history, err := storer.GetUserHistory("U1")
+	a.NoError(err)
+	a.Len(history, 1)
+	// the stale event was handled so is not replayed
+	pending, err := storer.PendingEvents()
+	a.NoError(err)
+	a.Empty(pending)
+}
+
+func TestUserMappingRoundTrip(t *testing.T) {
+	a := assert.New(t)
+	for i := 0; i < 10; i++ {
+		user := util.GenerateRandomUser("")
+		dbUser := APIToDBUser(user)
+		a.Equal(user.Profile.Email, dbUser.ProfileEmail)
+		a.Equal(int64(user.Updated), dbUser.Updated)
+		a.Len(dbUser.ProfileFields, 1)
+		a.Equal(user, DBToAPIUser(dbUser))
+	}
+
+	// users without custom fields map to a nil map
+	a.Nil(APIToDBUser(slack.User{ID: "U1"}).ProfileFields)
+}
+
+func generateUsers(n int) []slack.User {
+	users := make([]slack.User, n)
+	for i := range users {
+		users[i] = util.GenerateRandomUser("")
+	}
+	return users
+}
+
+func TestFetchUsers(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	slacker := &fakeSlacker{users: generateUsers(5), pageSize: 2}
+	app := &App{db: storer, slackClient: slacker}
+
+	a.NoError(app.FetchUsers(context.Background()))
+	a.Equal(3, slacker.callCount())
+	for _, u := range slacker.users {
+		stored, err := storer.GetUser(u.ID)
+		a.NoError(err)
+		a.Equal(APIToDBUser(u), stored)
+		history, err := storer.GetUserHistory(u.ID)
+		a.NoError(err)
+		a.Equal(db.SourceInitialSync, history[0].Source)
+	}
+
+	slacker.errs = []error{errors.New("slack down")}
+	a.Error(app.FetchUsers(context.Background()))
+
+	storer.err = errors.New("db down")
+	a.Error(app.FetchUsers(context.Background()))
+}
+
+func TestFetchUsersLoop(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	slacker := &fakeSlacker{users: generateUsers(3),
+		errs: []error{errors.New("slack down"), errors.New("still down")}}
+	clock := backofftest.NewFakeClock()
+	app := &App{db: storer, slackClient: slacker, clock: clock,
+		fetchBackoff: backoff.Policy{Base: time.Second}}
+
+	// returns once an attempt succeeds, backing off exponentially
+	app.FetchUsersLoop(context.Background())
+	a.Equal(3, slacker.callCount())
+	a.Equal([]time.Duration{time.Second, 2 * time.Second}, clock.Waits())
+	page, err := storer.GetUsersPage("", 0)
+	a.NoError(err)
+	a.Len(page.Users, 3)
+}
+
+func TestFetchUsersLoopRateLimited(t *testing.T) {
+	a := assert.New(t)
+	slacker := &fakeSlacker{users: generateUsers(3), errs: []error{
+		&slack.RateLimitedError{RetryAfter: 30 * time.Second}, errors.New("slack down")}}
+	clock := backofftest.NewFakeClock()
+	app := &App{db: newFakeStorer(), slackClient: slacker, clock: clock,
+		fetchBackoff: backoff.Policy{Base: time.Second},
+		slackBreaker: backoff.NewBreaker(DefaultBreakerThreshold, time.Minute, clock)}
+
+	// slack's Retry-After is waited out before the page is retried and opens
+	// the breaker, so the failed call which follows reopens it and the next
+	// attempt waits for the cooldown rather than the backoff delay
+	app.FetchUsersLoop(context.Background())
+	a.Equal(3, slacker.callCount())
+	a.Equal([]time.Duration{30 * time.Second, time.Second, 59 * time.Second}, clock.Waits())
+	a.Equal(backoff.Closed, app.slackBreaker.State())
+}
+
+func TestFetchUsersRateLimitedPage(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	// the second page is rate limited
+	slacker := &fakeSlacker{users: generateUsers(5), pageSize: 2, errs: []error{
+		nil, &slack.RateLimitedError{RetryAfter: 30 * time.Second}}}
+	clock := backofftest.NewFakeClock()
+	app := &App{db: storer, slackClient: slacker, clock: clock,
+		slackBreaker: backoff.NewBreaker(DefaultBreakerThreshold, time.Minute, clock)}
+
+	// only the rate limited page is retried rather than starting over
+	a.NoError(app.FetchUsers(context.Background()))
+	a.Equal(4, slacker.callCount())
+	a.Equal([]time.Duration{30 * time.Second}, clock.Waits())
+	page, err := storer.GetUsersPage("", 0)
+	a.NoError(err)
+	a.Len(page.Users, 5)
+}
+
+func TestFetchUsersBreaker(t *testing.T) {
+	a := assert.New(t)
+	slacker := &fakeSlacker{users: generateUsers(3), errs: []error{
+		errors.New("slack down"), errors.New("slack down")}}
+	clock := backofftest.NewFakeClock()
+	app := &App{db: newFakeStorer(), slackClient: slacker,
+		slackBreaker: backoff.NewBreaker(2, time.Minute, clock)}
+
+	a.Error(app.FetchUsers(context.Background()))
+	a.Error(app.FetchUsers(context.Background()))
+	// slack is not called while the breaker is open, for resyncs too
+	err := app.FetchUsers(context.Background())
+	a.True(errors.Is(err, backoff.ErrOpen), err)
+	_, err = app.Resync(context.Background())
+	a.True(errors.Is(err, backoff.ErrOpen), err)
+	a.Equal(2, slacker.callCount())
+
+	clock.Advance(time.Minute)
+	a.NoError(app.FetchUsers(context.Background()))
+	a.Equal(3, slacker.callCount())
+}
+
+func TestFetchUsersLoopCancelled(t *testing.T) {
+	a := assert.New(t)
+	slacker := &fakeSlacker{errs: []error{errors.New("slack down")}}
+	app := &App{db: newFakeStorer(), slackClient: slacker,
+		fetchBackoff: backoff.Policy{Base: time.Hour}}
+
+	// returns without waiting out the retry delay once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		app.FetchUsersLoop(ctx)
+		close(done)
+	}()
+	// cancel once the first attempt has failed and the loop is backing off
+	for i := 0; i < 500 && slacker.callCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		a.FailNow("FetchUsersLoop did not return after ctx was cancelled")
+	}
+	a.Equal(1, slacker.callCount())
+}
+
+func TestShutdown(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	slacker := &fakeSlacker{users: generateUsers(3)}
+	verifier, err := NewVerifier(testSigningSecret, "", DefaultReplayWindow)
+	a.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app := NewApp()
+	cfg := DefaultConfig()
+	cfg.Port = "0"
+	cfg.Sync.Interval = time.Millisecond
+	a.NoError(app.Init(ctx, cfg, storer, slacker, verifier))
+	runErr := make(chan error, 1)
+	go func() { runErr <- app.Run() }()
+
+	// wait for the initial fetch so the sync loop is running
+	for i := 0; i < 500; i++ {
+		if page, _ := storer.GetUsersPage("", 0); len(page.Users) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	a.NoError(app.Shutdown(shutdownCtx))
+	a.NoError(<-runErr)
+}
+
+// TestInitBreakerClock checks the breaker built by Init uses the app's clock,
+// the fake clock lets the fetch wait out the open breaker immediately
+func TestInitBreakerClock(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	down := errors.New("slack down")
+	slacker := &fakeSlacker{users: generateUsers(3),
+		errs: []error{down, down, down, down, down}}
+	verifier, err := NewVerifier(testSigningSecret, "", DefaultReplayWindow)
+	a.NoError(err)
+	clock := backofftest.NewFakeClock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app := NewApp()
+	app.clock = clock
+	a.NoError(app.Init(ctx, DefaultConfig(), storer, slacker, verifier))
+	for i := 0; i < 500 && app.lastSyncTime().IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.False(app.lastSyncTime().IsZero(), "users were not fetched")
+	a.Equal(6, slacker.callCount())
+	// the fifth failure opened the breaker, the backoff delay after it and
+	// the rest of the cooldown were waited on the fake clock
+	waits := clock.Waits()
+	if a.Len(waits, 6) {
+		a.Equal(DefaultBreakerCooldown, waits[4]+waits[5])
+	}
+}
+
+func TestResync(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	users := generateUsers(3)
+	users[2].Deleted = false // deleted users are not reported missing
+	slacker := &fakeSlacker{users: users}
+	app := &App{db: storer, slackClient: slacker}
+	a.NoError(app.FetchUsers(context.Background()))
+
+	// drift: a changed user, a new user and a user removed from slack
+	changed := util.MutateUser(&users[0])
+	added := util.GenerateRandomUser("")
+	slacker.setUsers([]slack.User{changed, users[1], added})
+
+	drift := func() []float64 {
+		return []float64{
+			testutil.ToFloat64(resyncDrift.WithLabelValues("added")),
+			testutil.ToFloat64(resyncDrift.WithLabelValues("changed")),
+			testutil.ToFloat64(resyncDrift.WithLabelValues("missing")),
+		}
+	}
+	before := drift()
+
+	summary, err := app.Resync(context.Background())
+	a.NoError(err)
+	a.Equal([]string{changed.ID}, summary.Changed)
+	a.Equal([]string{added.ID}, summary.Added)
+	a.Equal([]string{users[2].ID}, summary.Missing)
+	a.Equal(1, summary.Unchanged)
+	after := drift()
+	for i := range before {
+		a.Equal(before[i]+1, after[i], "drift %d", i)
+	}
+
+	stored, err := storer.GetUser(changed.ID)
+	a.NoError(err)
+	a.Equal(APIToDBUser(changed), stored)
+	stored, err = storer.GetUser(users[2].ID)
+	a.NoError(err)
+	a.True(stored.Deleted)
+	history, err := storer.GetUserHistory(users[2].ID)
+	a.NoError(err)
+	a.Equal(db.SourceResync, history[0].Source)
+
+	// nothing left to reconcile
+	summary, err = app.Resync(context.Background())
+	a.NoError(err)
+	a.False(summary.Drifted())
+	a.Equal(after, drift())
+}
+
+// TestWebhookFlow runs the initial fetch followed by webhook updates and
+// reads the result back from the api
+func TestWebhookFlow(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	users := generateUsers(10)
+	app := newTestApp(t, storer)
+	app.slackClient = &fakeSlacker{users: users}
+	a.NoError(app.FetchUsers(context.Background()))
+
+	for i := 0; i < 5; i++ {
+		users[i] = util.MutateUser(&users[i])
+		body := util.GenerateUpdateEvent(users[i], "")
+		w := postWebhook(app, signedHeader(testSigningSecret, time.Now(), body), body)
+		a.Equal(http.StatusOK, w.Code)
+	}
+
+	w := serve(app, http.MethodGet, "/api/v1/users")
+	a.Equal(http.StatusOK, w.Code)
+	var resp UsersResponse
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	expected := APIToDBUsers(users)
+	sort.Slice(expected, func(i, j int) bool { return expected[i].ID < expected[j].ID })
+	a.Equal(expected, resp.Users)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/backoff"
+	log "github.com/cocoonlife/timber"
+	"github.com/slack-go/slack"
+)
+
+// slackPagesTTL is how long the pagination of an abandoned fetch of users is
+// kept for before it is forgotten
+const slackPagesTTL = time.Hour
+
+// slackPager adapts slack.Client's user pagination to Slacker. slack-go does
+// not expose its cursors so each page's pagination is kept under a cursor of
+// our own
+type slackPager struct {
+	client *slack.Client
+
+	mu    sync.Mutex
+	next  int64
+	pages map[string]slackPage
+}
+
+type slackPage struct {
+	pagination slack.UserPagination
+	created    time.Time
+}
+
+// NewSlacker returns a Slacker which calls the slack api with client
+func NewSlacker(client *slack.Client) Slacker {
+	return &slackPager{client: client, pages: map[string]slackPage{}}
+}
+
+// GetUsersPage implements Slacker, a failed page can be retried with the
+// same cursor
+func (s *slackPager) GetUsersPage(ctx context.Context, cursor string) ([]slack.User, string, error) {
+	p, err := s.pagination(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := p.Next(ctx)
+	if p.Done(err) {
+		s.forget(cursor)
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pages, cursor)
+	s.next++
+	nextCursor := strconv.FormatInt(s.next, 10)
+	s.pages[nextCursor] = slackPage{pagination: next, created: time.Now()}
+	return next.Users, nextCursor, nil
+}
+
+// pagination returns the pagination for a cursor, a new one for the first
+// page, which is also when those of abandoned fetches are forgotten
+func (s *slackPager) pagination(cursor string) (slack.UserPagination, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cursor == "" {
+		for c, page := range s.pages {
+			if time.Since(page.created) > slackPagesTTL {
+				delete(s.pages, c)
+			}
+		}
+		return s.client.GetUsersPaginated(), nil
+	}
+	page, ok := s.pages[cursor]
+	if !ok {
+		return slack.UserPagination{}, fmt.Errorf("unknown users cursor %q", cursor)
+	}
+	return page.pagination, nil
+}
+
+func (s *slackPager) forget(cursor string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pages, cursor)
+}
+
+// getUsers fetches every user from slack a page at a time, each call going
+// through the circuit breaker so that we back off from slack while it is
+// failing or rate limiting us. A page which is rate limited is retried once
+// slack's Retry-After has passed, rather than starting over, other failures
+// fail the fetch
+func (a *App) getUsers(ctx context.Context) ([]slack.User, error) {
+	var users []slack.User
+	cursor := ""
+	for {
+		var page []slack.User
+		var next string
+		err := a.slackBreaker.Do(func() error {
+			var err error
+			page, next, err = a.slackClient.GetUsersPage(ctx, cursor)
+			return slackRetryAfter(err)
+		})
+		var rateLimited *slack.RateLimitedError
+		if errors.As(err, &rateLimited) {
+			select {
+			case <-ctx.Done():
+				return users, err
+			case <-a.clockOrDefault().After(rateLimited.RetryAfter):
+			}
+			continue
+		}
+		if errors.Is(err, backoff.ErrOpen) {
+			log.Warnf("not calling slack: %v", err)
+		}
+		if err != nil {
+			return users, err
+		}
+		users = append(users, page...)
+		if next == "" {
+			return users, nil
+		}
+		cursor = next
+	}
+}
+
+// clockOrDefault returns the app's clock, the wall clock unless faked
+func (a *App) clockOrDefault() backoff.Clock {
+	if a.clock == nil {
+		return backoff.RealClock
+	}
+	return a.clock
+}
+
+// slackRetryAfter wraps slack's rate limit errors with how long slack asked us
+// to wait
+func slackRetryAfter(err error) error {
+	var rateLimited *slack.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		log.Warnf("rate limited by slack, retrying after %s", rateLimited.RetryAfter)
+		return backoff.RetryAfter(err, rateLimited.RetryAfter)
+	}
+	return err
+}
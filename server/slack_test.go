@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+)
+
+// slackAPI serves users.list from users, pageSize at a time, answering the
+// requests numbered in rateLimited with a 429
+func slackAPI(t *testing.T, users []slack.User, pageSize int, rateLimited ...int) *slack.Client {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		for _, n := range rateLimited {
+			if n == requests {
+				w.Header().Set("Retry-After", "30")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+		start, _ := strconv.Atoi(req.FormValue("cursor"))
+		end := start + pageSize
+		var next string
+		if end < len(users) {
+			next = strconv.Itoa(end)
+		} else {
+			end = len(users)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":                true,
+			"members":           users[start:end],
+			"response_metadata": map[string]string{"next_cursor": next},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return slack.New("xoxb-test", slack.OptionAPIURL(server.URL+"/"))
+}
+
+func TestSlackerGetUsersPage(t *testing.T) {
+	a := assert.New(t)
+	users := generateUsers(5)
+	// the second page is rate limited
+	slacker := NewSlacker(slackAPI(t, users, 2, 2))
+	ctx := context.Background()
+
+	page, cursor, err := slacker.GetUsersPage(ctx, "")
+	a.NoError(err)
+	a.Len(page, 2)
+	a.NotEmpty(cursor)
+
+	_, _, err = slacker.GetUsersPage(ctx, cursor)
+	var rateLimited *slack.RateLimitedError
+	if a.True(errors.As(err, &rateLimited), err) {
+		a.Equal(30*time.Second, rateLimited.RetryAfter)
+	}
+
+	// the rate limited page is retried with the same cursor
+	fetched := page
+	for cursor != "" {
+		page, cursor, err = slacker.GetUsersPage(ctx, cursor)
+		a.NoError(err)
+		fetched = append(fetched, page...)
+	}
+	a.Len(fetched, len(users))
+	for i := range users {
+		a.Equal(users[i].ID, fetched[i].ID)
+	}
+
+	_, _, err = slacker.GetUsersPage(ctx, "404")
+	a.Error(err)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	log "github.com/cocoonlife/timber"
+)
+
+// DefaultSyncInterval is how often users are reconciled against slack
+const DefaultSyncInterval = time.Hour
+
+// SyncSummary describes how the stored users had drifted from slack when
+// they were reconciled
+type SyncSummary struct {
+	// Fetched is the number of users returned by slack
+	Fetched int
+	// Added are ids of users in slack which were not stored
+	Added []string
+	// Changed are ids of stored users whose data differed from slack
+	Changed []string
+	// Missing are ids of stored users which slack no longer returns, they are
+	// marked as deleted
+	Missing []string
+	// Unchanged is the number of stored users which matched slack
+	Unchanged int
+	// Stale is the number of users slack returned older data for than is
+	// stored, e.g. as a webhook arrived during the resync, they are left alone
+	Stale int
+}
+
+// Drifted reports whether any stored user differed from slack
+func (s SyncSummary) Drifted() bool {
+	return len(s.Added)+len(s.Changed)+len(s.Missing) > 0
+}
+
+func (s SyncSummary) String() string {
+	return fmt.Sprintf("fetched %d users, %d added, %d changed, %d missing from slack, %d unchanged, %d stale",
+		s.Fetched, len(s.Added), len(s.Changed), len(s.Missing), s.Unchanged, s.Stale)
+}
+
+// diffUsers compares the stored users against those fetched from slack and
+// returns a summary along with the users which need writing to bring the
+// store up to date
+func diffUsers(stored, fetched []db.User) (SyncSummary, []db.User) {
+	summary := SyncSummary{Fetched: len(fetched)}
+	storedByID := make(map[string]db.User, len(stored))
+	for _, u := range stored {
+		storedByID[u.ID] = u
+	}
+
+	var writes []db.User
+	for _, u := range fetched {
+		existing, ok := storedByID[u.ID]
+		delete(storedByID, u.ID)
+		switch {
+		case !ok:
+			summary.Added = append(summary.Added, u.ID)
+			writes = append(writes, u)
+		case !existing.Equal(u):
+			summary.Changed = append(summary.Changed, u.ID)
+			writes = append(writes, u)
+		default:
+			summary.Unchanged++
+		}
+	}
+
+	// slack lists deactivated users so users it no longer returns at all
+	// have been removed from the workspace
+	for _, u := range storedByID {
+		if u.Deleted {
+			summary.Unchanged++
+			continue
+		}
+		summary.Missing = append(summary.Missing, u.ID)
+		u.Deleted = true
+		writes = append(writes, u)
+	}
+	sort.Strings(summary.Missing)
+	return summary, writes
+}
+
+// allUsers reads every stored user a page at a time
+func (a *App) allUsers() ([]db.User, error) {
+	var users []db.User
+	cursor := ""
+	for {
+		page, err := a.db.GetUsersPage(cursor, db.MaxPageSize)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, page.Users...)
+		if page.NextCursor == "" {
+			return users, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// Resync fetches every user from slack and reconciles the store with them,
+// catching up on any changes whose webhooks we missed
+func (a *App) Resync(ctx context.Context) (summary SyncSummary, err error) {
+	defer func(start time.Time) { observeSync("resync", start, err) }(time.Now())
+	users, err := a.getUsers(ctx)
+	if err != nil {
+		return SyncSummary{}, fmt.Errorf("failed api call to slack GetUsers: %w", err)
+	}
+	syncUsersFetched.WithLabelValues("resync").Set(float64(len(users)))
+	stored, err := a.allUsers()
+	if err != nil {
+		return SyncSummary{}, fmt.Errorf("failed to read stored users: %v", err)
+	}
+
+	summary, writes := diffUsers(stored, APIToDBUsers(users))
+	summary, err = a.writeDrift(summary, writes)
+	observeDrift(summary)
+	if err != nil {
+		return summary, err
+	}
+	a.syncSucceeded()
+	return summary, nil
+}
+
+// writeDrift writes the users which drifted from slack and returns the summary
+// with only the users which were written, users whose stored data turned out
+// to be newer than slack's are counted as stale instead
+func (a *App) writeDrift(summary SyncSummary, writes []db.User) (SyncSummary, error) {
+	written := make(map[string]bool, len(writes))
+	var err error
+	for _, u := range writes {
+		var changed bool
+		changed, err = a.db.UpdateUser(u, db.Origin{Source: db.SourceResync})
+		if errors.Is(err, db.ErrStaleUser) {
+			log.Debugf("resync skipped stale user %s", u.ID)
+			summary.Stale++
+			err = nil
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("failed db UpdateUser call: %v", err)
+			break
+		}
+		if changed {
+			written[u.ID] = true
+		} else {
+			// changed by a webhook to match slack since it was read
+			summary.Unchanged++
+		}
+	}
+	usersWritten.WithLabelValues(string(db.SourceResync)).Add(float64(len(written)))
+
+	keep := func(ids []string) []string {
+		var kept []string
+		for _, id := range ids {
+			if written[id] {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	}
+	summary.Added = keep(summary.Added)
+	summary.Changed = keep(summary.Changed)
+	summary.Missing = keep(summary.Missing)
+	return summary, err
+}
+
+// SyncLoop periodically reconciles the store with slack until ctx is done,
+// call this in a goroutine once the initial fetch has succeeded
+func (a *App) SyncLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Infof("periodic resync disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// events whose write failed after slack was acknowledged are only
+		// recovered by replaying them as slack does not retry them, those
+		// received since the last tick may still be queued so are left
+		a.replayInbox(time.Now().Add(-interval))
+
+		start := time.Now()
+		resyncCtx, cancelFunc := context.WithTimeout(ctx, durationOrDefault(a.resyncTimeout, DefaultResyncTimeout))
+		summary, err := a.Resync(resyncCtx)
+		cancelFunc()
+		if err != nil {
+			log.Errorf("resync failed: %v", err)
+			continue
+		}
+		if summary.Drifted() {
+			log.Warnf("resync in %s found drift: %s", time.Since(start), summary)
+			log.Debugf("resync added %v, changed %v, missing %v",
+				summary.Added, summary.Changed, summary.Missing)
+		} else {
+			log.Infof("resync in %s: %s", time.Since(start), summary)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aultimus/slack-user-data-service/db"
+	"github.com/aultimus/slack-user-data-service/util"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffUsers(t *testing.T) {
+	a := assert.New(t)
+	stored := []db.User{
+		{ID: "U1", Name: "unchanged"},
+		{ID: "U2", Name: "before"},
+		{ID: "U3", Name: "removed"},
+		{ID: "U4", Name: "already deleted", Deleted: true},
+	}
+	fetched := []db.User{
+		{ID: "U1", Name: "unchanged"},
+		{ID: "U2", Name: "after"},
+		{ID: "U5", Name: "new"},
+	}
+
+	summary, writes := diffUsers(stored, fetched)
+	a.Equal(SyncSummary{
+		Fetched:   3,
+		Added:     []string{"U5"},
+		Changed:   []string{"U2"},
+		Missing:   []string{"U3"},
+		Unchanged: 2,
+	}, summary)
+	a.True(summary.Drifted())
+	a.Equal([]db.User{
+		{ID: "U2", Name: "after"},
+		{ID: "U5", Name: "new"},
+		{ID: "U3", Name: "removed", Deleted: true},
+	}, writes)
+
+	summary, writes = diffUsers(fetched, fetched)
+	a.False(summary.Drifted())
+	a.Empty(writes)
+	a.Equal(3, summary.Unchanged)
+}
+
+// TestResyncSkipsStaleUsers checks a user changed by a webhook after slack
+// listed it is left alone and not reported as drift
+func TestResyncSkipsStaleUsers(t *testing.T) {
+	a := assert.New(t)
+	storer := newFakeStorer()
+	users := generateUsers(2)
+	slacker := &fakeSlacker{users: users}
+	app := &App{db: storer, slackClient: slacker}
+	a.NoError(app.FetchUsers(context.Background()))
+
+	newer := APIToDBUser(util.MutateUser(&users[0]))
+	newer.Updated = int64(users[0].Updated) + 1
+	_, err := storer.UpdateUser(newer, db.Origin{Source: db.SourceWebhook, EventID: "Ev01"})
+	a.NoError(err)
+	changed := testutil.ToFloat64(resyncDrift.WithLabelValues("changed"))
+
+	summary, err := app.Resync(context.Background())
+	a.NoError(err)
+	a.False(summary.Drifted())
+	a.Equal(1, summary.Stale)
+	a.Equal(1, summary.Unchanged)
+	a.Equal(changed, testutil.ToFloat64(resyncDrift.WithLabelValues("changed")))
+	stored, err := storer.GetUser(newer.ID)
+	a.NoError(err)
+	a.Equal(newer, stored)
+}
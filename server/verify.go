@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderSlackSignature = "X-Slack-Signature"
+	HeaderSlackTimestamp = "X-Slack-Request-Timestamp"
+	// DefaultReplayWindow is how far a request timestamp may drift from our
+	// clock before the request is rejected as a possible replay
+	DefaultReplayWindow = 5 * time.Minute
+
+	signatureVersion = "v0"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing slack signature headers")
+	ErrInvalidSignature = errors.New("invalid slack signature")
+	ErrExpiredTimestamp = errors.New("slack request timestamp outside replay window")
+	ErrInvalidToken     = errors.New("invalid slack verification token")
+	ErrNoVerification   = errors.New("neither a signing secret nor a verification token is configured")
+)
+
+// Verifier authenticates requests sent to us by slack using the signing
+// secret scheme https://api.slack.com/authentication/verifying-requests-from-slack
+// Verification tokens are deprecated by slack so are only checked when
+// explicitly configured, and then only for requests which are not signed
+type Verifier struct {
+	signingSecret     string
+	verificationToken string
+	replayWindow      time.Duration
+	now               func() time.Time
+}
+
+// NewVerifier returns a Verifier, pass an empty verificationToken to disable
+// the token fallback
+func NewVerifier(signingSecret, verificationToken string,
+	replayWindow time.Duration) (*Verifier, error) {
+	if signingSecret == "" && verificationToken == "" {
+		return nil, ErrNoVerification
+	}
+	return &Verifier{
+		signingSecret:     signingSecret,
+		verificationToken: verificationToken,
+		replayWindow:      replayWindow,
+		now:               time.Now,
+	}, nil
+}
+
+// ComputeSignature returns the X-Slack-Signature value slack would send for
+// the given body and X-Slack-Request-Timestamp value
+func ComputeSignature(signingSecret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(signatureVersion + ":" + timestamp + ":"))
+	mac.Write(body)
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns nil if the request with the given headers and body was
+// sent by slack
+func (v *Verifier) Verify(header http.Header, body []byte) error {
+	signed := header.Get(HeaderSlackSignature) != "" ||
+		header.Get(HeaderSlackTimestamp) != ""
+	if v.signingSecret != "" && (signed || v.verificationToken == "") {
+		return v.verifySignature(header, body)
+	}
+	if v.verificationToken == "" {
+		return ErrMissingSignature
+	}
+	return v.verifyToken(body)
+}
+
+func (v *Verifier) verifySignature(header http.Header, body []byte) error {
+	signature := header.Get(HeaderSlackSignature)
+	timestamp := header.Get(HeaderSlackTimestamp)
+	if signature == "" || timestamp == "" {
+		return ErrMissingSignature
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	age := v.now().Sub(time.Unix(secs, 0))
+	if age > v.replayWindow || age < -v.replayWindow {
+		return ErrExpiredTimestamp
+	}
+
+	expected := ComputeSignature(v.signingSecret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (v *Verifier) verifyToken(body []byte) error {
+	var payload struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if subtle.ConstantTimeCompare([]byte(payload.Token), []byte(v.verificationToken)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
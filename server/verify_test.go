@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+func signedHeader(secret string, ts time.Time, body []byte) http.Header {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	header := http.Header{}
+	header.Set(HeaderSlackTimestamp, timestamp)
+	header.Set(HeaderSlackSignature, ComputeSignature(secret, timestamp, body))
+	return header
+}
+
+func TestComputeSignature(t *testing.T) {
+	// example taken from https://api.slack.com/authentication/verifying-requests-from-slack
+	body := []byte("token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c")
+	assert.Equal(t, "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503",
+		ComputeSignature(testSigningSecret, "1531420618", body))
+}
+
+func TestVerifierSignature(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(1531420618, 0)
+	v, err := NewVerifier(testSigningSecret, "", DefaultReplayWindow)
+	a.NoError(err)
+	v.now = func() time.Time { return now }
+
+	body := []byte(`{"type":"event_callback"}`)
+	a.NoError(v.Verify(signedHeader(testSigningSecret, now, body), body))
+	a.NoError(v.Verify(signedHeader(testSigningSecret, now.Add(-4*time.Minute), body), body))
+
+	a.Equal(ErrInvalidSignature, v.Verify(signedHeader("wrong", now, body), body))
+	a.Equal(ErrInvalidSignature, v.Verify(signedHeader(testSigningSecret, now, body), []byte("tampered")))
+	a.Equal(ErrExpiredTimestamp, v.Verify(signedHeader(testSigningSecret, now.Add(-6*time.Minute), body), body))
+	a.Equal(ErrExpiredTimestamp, v.Verify(signedHeader(testSigningSecret, now.Add(6*time.Minute), body), body))
+	a.Equal(ErrMissingSignature, v.Verify(http.Header{}, body))
+
+	header := signedHeader(testSigningSecret, now, body)
+	header.Set(HeaderSlackTimestamp, "yesterday")
+	a.True(errors.Is(v.Verify(header, body), ErrInvalidSignature))
+}
+
+func TestVerifierTokenFallback(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	body := []byte(`{"token":"secret-token","type":"event_callback"}`)
+	badBody := []byte(`{"token":"foo","type":"event_callback"}`)
+
+	_, err := NewVerifier("", "", DefaultReplayWindow)
+	a.Equal(ErrNoVerification, err)
+
+	// token only
+	v, err := NewVerifier("", "secret-token", DefaultReplayWindow)
+	a.NoError(err)
+	a.NoError(v.Verify(http.Header{}, body))
+	a.Equal(ErrInvalidToken, v.Verify(http.Header{}, badBody))
+
+	// signing secret with token fallback for unsigned requests only
+	v, err = NewVerifier(testSigningSecret, "secret-token", DefaultReplayWindow)
+	a.NoError(err)
+	a.NoError(v.Verify(signedHeader(testSigningSecret, now, badBody), badBody))
+	a.NoError(v.Verify(http.Header{}, body))
+	a.Equal(ErrInvalidToken, v.Verify(http.Header{}, badBody))
+	a.Equal(ErrInvalidSignature, v.Verify(signedHeader("wrong", now, body), body))
+}
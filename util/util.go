@@ -1,8 +1,10 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	log "github.com/cocoonlife/timber"
@@ -16,17 +18,18 @@ func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
 }
 
-func WaitForDB(dbConnStr string) (*sqlx.DB, error) {
-	maxRetries := 10
+// WaitForDB connects to and pings the database, making up to maxRetries
+// attempts at each interval apart as the database may still be starting
+func WaitForDB(driverName, dbConnStr string, maxRetries int, interval time.Duration) (*sqlx.DB, error) {
 	var handle *sqlx.DB
 	var err error
 
 	for i := 0; i < maxRetries; i++ {
-		handle, err = sqlx.Connect("postgres", dbConnStr)
+		handle, err = sqlx.Connect(driverName, dbConnStr)
 		if err != nil {
 			if i < maxRetries-1 {
 				log.Infof("sleeping for db connect")
-				time.Sleep(time.Second)
+				time.Sleep(interval)
 				continue
 			}
 			return nil, err
@@ -40,7 +43,7 @@ func WaitForDB(dbConnStr string) (*sqlx.DB, error) {
 		if err = handle.Ping(); err != nil {
 			if i < maxRetries-1 {
 				log.Infof("sleeping for db ping")
-				time.Sleep(time.Second)
+				time.Sleep(interval)
 				continue
 			}
 			return nil, err
@@ -52,35 +55,54 @@ func WaitForDB(dbConnStr string) (*sqlx.DB, error) {
 }
 
 func GenerateUpdateEvent(user slack.User, token string) []byte {
-	updateEventTemplate := `
+	return GenerateUpdateEventAt(user, token, newEventID(), time.Now())
+}
+
+// GenerateUpdateEventAt generates a user_change event with the given event id
+// and event time, e.g. to simulate retries or events delivered out of order
+func GenerateUpdateEventAt(user slack.User, token, eventID string, eventTime time.Time) []byte {
+	return generateUserEvent("user_change", user, token, eventID, eventTime)
+}
+
+func GenerateTeamJoinEvent(user slack.User, token string) []byte {
+	return generateUserEvent("team_join", user, token, newEventID(), time.Now())
+}
+
+// newEventID returns a random id in the format of slack event ids
+func newEventID() string {
+	return "Ev" + strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", "")[:10])
+}
+
+func generateUserEvent(eventType string, user slack.User, token, eventID string,
+	eventTime time.Time) []byte {
+	// marshal the user rather than templating it so that every field we
+	// persist is carried by the event
+	event := map[string]interface{}{
+		"token": token,
+		"event": map[string]interface{}{
+			"type": eventType,
+			"user": user,
+		},
+		"type":       "event_callback",
+		"event_id":   eventID,
+		"event_time": eventTime.Unix(),
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		panic(err) // slack.User always marshals
+	}
+	return b
+}
+
+func GenerateURLVerificationEvent(challenge string, token string) []byte {
+	urlVerificationTemplate := `
 	{
 		"token": "%s",
-		"event": {
-			"type": "user_change",
-			"user": {
-				"id": "%s",
-				"name": "%s",
-				"deleted": %s,
-				"profile": {
-					"image_512": "%s",
-					"status_emoji": "%s",
-					"status_text": "%s"
-				},
-				"real_name": "%s",
-				"tz": "%s"
-			}
-		},
-		"type": "event_callback"
+		"challenge": "%s",
+		"type": "url_verification"
 	}
 	`
-	deleted := "false"
-	if user.Deleted {
-		deleted = "true"
-	}
-	s := fmt.Sprintf(updateEventTemplate, token, user.ID, user.Name, deleted,
-		user.Profile.Image512, user.Profile.StatusEmoji, user.Profile.StatusText,
-		user.RealName, user.TZ)
-	return []byte(s)
+	return []byte(fmt.Sprintf(urlVerificationTemplate, token, challenge))
 }
 
 func GenerateRandomUser(id string) slack.User {
@@ -102,18 +124,32 @@ func GenerateRandomUser(id string) slack.User {
 		deleted = true
 	}
 
-	return slack.User{
+	titles := []string{"engineer", "designer", "manager", "recruiter"}
+
+	user := slack.User{
 		ID:       id,
 		Name:     name,
 		RealName: name + " real",
 		Deleted:  deleted,
 		TZ:       timezones[rand.Intn(len(timezones))],
+		IsAdmin:  rand.Intn(4) == 0,
+		IsBot:    rand.Intn(10) == 0,
+		Updated:  slack.JSONTime(time.Now().Unix()),
 		Profile: slack.UserProfile{
 			Image512:    "http://imgur.com/" + name + ".png",
+			Image72:     "http://imgur.com/" + name + "_72.png",
 			StatusEmoji: emojis[rand.Intn(len(emojis))],
 			StatusText:  statusTexts[rand.Intn(len(statusTexts))],
+			DisplayName: name,
+			Email:       name + "@example.com",
+			Phone:       fmt.Sprintf("+1555%07d", rand.Intn(10000000)),
+			Title:       titles[rand.Intn(len(titles))],
 		},
 	}
+	user.Profile.SetFieldsMap(map[string]slack.UserProfileCustomField{
+		"Xf0000001": {Value: statusTexts[rand.Intn(len(statusTexts))], Label: "hobby"},
+	})
+	return user
 }
 
 func MutateUser(user *slack.User) slack.User {